@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"os"
 
 	yaml "gopkg.in/yaml.v2"
 	"novit.nc/direktil/pkg/localconfig"
@@ -15,11 +20,26 @@ var (
 	dir          = flag.String("in", ".", "Source directory")
 	outPath      = flag.String("out", "config.yaml", "Output file")
 	defaultsPath = flag.String("defaults", "defaults", "Path to the defaults")
+	signKeyPath  = flag.String("sign-key", "", "ed25519 private key (PKCS#8 PEM) to sign the output with, writing <out>.sig")
 
 	src *clustersconfig.Config
 	dst *localconfig.Config
+
+	hostsMeta = map[string]hostMeta{}
 )
 
+// hostMeta is the host's placement, not carried by localconfig but used by the local server.
+type hostMeta struct {
+	Cluster string
+	Group   string
+}
+
+type output struct {
+	localconfig.Config `yaml:",inline"`
+
+	HostMeta map[string]hostMeta `yaml:"host_meta"`
+}
+
 func loadSrc() {
 	var err error
 	src, err = clustersconfig.FromDir(*dir, *defaultsPath)
@@ -88,18 +108,53 @@ func main() {
 
 			Config: ctx.Config(),
 		})
+
+		hostsMeta[host.Name] = hostMeta{
+			Cluster: host.Cluster,
+			Group:   host.Group,
+		}
 	}
 
 	// ----------------------------------------------------------------------
-	out, err := os.Create(*outPath)
+	ba, err := yaml.Marshal(output{*dst, hostsMeta})
 	if err != nil {
-		log.Fatal("failed to create output: ", err)
+		log.Fatal("failed to render output: ", err)
 	}
 
-	defer out.Close()
+	if err = ioutil.WriteFile(*outPath, ba, 0666); err != nil {
+		log.Fatal("failed to write output: ", err)
+	}
 
-	if err = yaml.NewEncoder(out).Encode(dst); err != nil {
-		log.Fatal("failed to render output: ", err)
+	if *signKeyPath != "" {
+		if err = writeSignature(ba); err != nil {
+			log.Fatal("failed to sign output: ", err)
+		}
 	}
+}
+
+// writeSignature writes the output's signature, to be sent in the X-Config-Signature header.
+func writeSignature(ba []byte) (err error) {
+	keyPEM, err := ioutil.ReadFile(*signKeyPath)
+	if err != nil {
+		return
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM data found", *signKeyPath)
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: not an ed25519 key (%T)", *signKeyPath, k)
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, ba))
 
+	return ioutil.WriteFile(*outPath+".sig", []byte(sig+"\n"), 0644)
 }
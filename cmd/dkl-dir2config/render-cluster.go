@@ -34,6 +34,10 @@ func clusterFuncs(clusterSpec *clustersconfig.Cluster) map[string]interface{} {
 			return fmt.Sprintf("{{ ca_crt %q %q }}", cluster, name), nil
 		},
 
+		"ca_chain": func(name string) (s string, err error) {
+			return fmt.Sprintf("{{ ca_chain %q %q }}", cluster, name), nil
+		},
+
 		"ca_dir": func(name string) (s string, err error) {
 			return fmt.Sprintf("{{ ca_dir %q %q }}", cluster, name), nil
 		},
@@ -208,6 +208,10 @@ func (ctx *renderContext) templateFuncs(ctxMap map[string]interface{}) map[strin
 			return getKeyCert(name, "tls_crt")
 		},
 
+		"tls_crt_chain": func(name string) (s string, err error) {
+			return getKeyCert(name, "tls_crt_chain")
+		},
+
 		"tls_dir": func(name string) (s string, err error) {
 			return getKeyCert(name, "tls_dir")
 		},
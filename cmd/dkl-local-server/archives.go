@@ -0,0 +1,279 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	ulidp "github.com/oklog/ulid"
+)
+
+var (
+	archivesKeep   = flag.Int("archives-keep", 0, "Number of config archives to keep (0 is unlimited)")
+	archivesMaxAge = flag.Duration("archives-max-age", 0, "Maximum age of config archives (0 is unlimited)")
+
+	errNoSuchArchive = errors.New("no such archive")
+)
+
+const (
+	archivePrefix = "config."
+	archiveSuffix = ".yaml.gz"
+)
+
+type configArchive struct {
+	ID   string
+	Time time.Time
+	Size int64
+	Meta *configMeta `json:",omitempty"`
+}
+
+// configMeta records where a config comes from.
+type configMeta struct {
+	Time      time.Time
+	Uploader  string
+	Signer    string `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+	// Restored is the ID of the archive the config was restored from
+	Restored string `json:",omitempty"`
+}
+
+func configMetaPath() string {
+	return filepath.Join(*dataDir, "config.meta.json")
+}
+
+func archivesPath() string {
+	return filepath.Join(*dataDir, "archives")
+}
+
+func archivePath(id string) string {
+	return filepath.Join(archivesPath(), archivePrefix+id+archiveSuffix)
+}
+
+func archiveMetaPath(id string) string {
+	return filepath.Join(archivesPath(), archivePrefix+id+".meta.json")
+}
+
+// readConfigMeta reads a config's meta, returning nil if it has none.
+func readConfigMeta(path string) (meta *configMeta, err error) {
+	ba, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	meta = &configMeta{}
+	err = json.Unmarshal(ba, meta)
+	return
+}
+
+// writeConfigMeta replaces the meta file (never written in place, so backups read it consistently).
+func writeConfigMeta(path string, meta *configMeta) (err error) {
+	ba, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(path), ".config-meta")
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(out.Name())
+
+	_, err = out.Write(ba)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+
+	return os.Rename(out.Name(), path)
+}
+
+// archiveMeta returns the meta of an archive, or nil if it has none.
+func archiveMeta(id string) (meta *configMeta, err error) {
+	if _, err = ulidp.ParseStrict(id); err != nil {
+		return nil, errNoSuchArchive
+	}
+
+	return readConfigMeta(archiveMetaPath(id))
+}
+
+// listArchives returns the config archives, newest first.
+func listArchives() (archives []configArchive, err error) {
+	archives = make([]configArchive, 0)
+
+	entries, err := ioutil.ReadDir(archivesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, archivePrefix) || !strings.HasSuffix(name, archiveSuffix) {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimPrefix(name, archivePrefix), archiveSuffix)
+
+		parsed, err := ulidp.ParseStrict(id)
+		if err != nil {
+			log.Printf("archives: ignoring %s: %v", name, err)
+			continue
+		}
+
+		meta, err := readConfigMeta(archiveMetaPath(id))
+		if err != nil {
+			log.Printf("archives: failed to read the meta of %s: %v", id, err)
+		}
+
+		archives = append(archives, configArchive{
+			ID:   id,
+			Time: ulidp.Time(parsed.Time()),
+			Size: entry.Size(),
+			Meta: meta,
+		})
+	}
+
+	sort.Slice(archives, func(i, j int) bool { return archives[i].ID > archives[j].ID })
+	return
+}
+
+// openArchive returns the decompressed content of an archive.
+func openArchive(id string) (rc io.ReadCloser, err error) {
+	if _, err = ulidp.ParseStrict(id); err != nil {
+		return nil, errNoSuchArchive
+	}
+
+	f, err := os.Open(archivePath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errNoSuchArchive
+		}
+		return
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	return &archiveReader{gz, f}, nil
+}
+
+type archiveReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *archiveReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+// archiveCurrentConfig saves the current config in the archives.
+// The returned ID is empty if there's no current config.
+func archiveCurrentConfig() (id string, err error) {
+	in, err := os.Open(configFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	defer in.Close()
+
+	err = os.MkdirAll(archivesPath(), 0700)
+	if err != nil {
+		return
+	}
+
+	id = ulid()
+
+	bck, err := os.Create(archivePath(id))
+	if err != nil {
+		return
+	}
+
+	defer bck.Close()
+
+	gz, err := gzip.NewWriterLevel(bck, 2)
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(gz, in)
+	if err2 := gz.Close(); err == nil {
+		err = err2
+	}
+
+	if err != nil {
+		os.Remove(bck.Name())
+		return
+	}
+
+	// the meta goes with its config; copied, so the current config keeps it until replaced
+	meta, err := ioutil.ReadFile(configMetaPath())
+	if err == nil {
+		err = ioutil.WriteFile(archiveMetaPath(id), meta, 0600)
+	}
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err != nil {
+		return
+	}
+
+	if err := pruneArchives(); err != nil {
+		log.Print("warn: failed to prune archives: ", err)
+	}
+
+	return
+}
+
+// pruneArchives applies the archives retention policy.
+func pruneArchives() error {
+	if *archivesKeep <= 0 && *archivesMaxAge <= 0 {
+		return nil
+	}
+
+	archives, err := listArchives()
+	if err != nil {
+		return err
+	}
+
+	for i, archive := range archives {
+		tooMany := *archivesKeep > 0 && i >= *archivesKeep
+		tooOld := *archivesMaxAge > 0 && time.Since(archive.Time) > *archivesMaxAge
+
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		log.Print("archives: removing ", archive.ID)
+		if err := os.Remove(archivePath(archive.ID)); err != nil {
+			return err
+		}
+		if err := os.Remove(archiveMetaPath(archive.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	ulidp "github.com/oklog/ulid"
+)
+
+// withDataDir uses a temporary data dir, returning a function restoring the previous one.
+func withDataDir(t *testing.T) (restore func()) {
+	dir, err := ioutil.TempDir("", "dkl-local-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := *dataDir
+	*dataDir = dir
+
+	return func() {
+		*dataDir = prev
+		os.RemoveAll(dir)
+	}
+}
+
+func writeTestArchive(t *testing.T, at time.Time, withMeta bool) string {
+	id := ulidp.MustNew(ulidp.Timestamp(at), rand.New(rand.NewSource(at.UnixNano()))).String()
+
+	if err := os.MkdirAll(archivesPath(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(archivePath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("hosts: []\n"))
+	gz.Close()
+	f.Close()
+
+	if withMeta {
+		if err := writeConfigMeta(archiveMetaPath(id), &configMeta{Time: at, Uploader: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return id
+}
+
+func TestPruneArchives(t *testing.T) {
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name   string
+		keep   int
+		maxAge time.Duration
+		expect []int // indexes of the remaining archives, newest first
+	}{
+		{"unlimited", 0, 0, []int{0, 1, 2, 3}},
+		{"keep 2", 2, 0, []int{0, 1}},
+		{"keep more than there is", 10, 0, []int{0, 1, 2, 3}},
+		{"max age", 0, 90 * time.Minute, []int{0, 1}},
+		{"keep and max age", 1, 90 * time.Minute, []int{0}},
+		{"max age removing everything", 0, time.Second, []int{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer withDataDir(t)()
+
+			prevKeep, prevMaxAge := *archivesKeep, *archivesMaxAge
+			defer func() { *archivesKeep, *archivesMaxAge = prevKeep, prevMaxAge }()
+
+			*archivesKeep, *archivesMaxAge = tc.keep, tc.maxAge
+
+			// newest first, one hour apart
+			ids := make([]string, 4)
+			for i := range ids {
+				ids[i] = writeTestArchive(t, now.Add(-time.Duration(i)*time.Hour-time.Minute), i%2 == 0)
+			}
+
+			if err := pruneArchives(); err != nil {
+				t.Fatal(err)
+			}
+
+			archives, err := listArchives()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(archives) != len(tc.expect) {
+				t.Fatalf("expected %d archives, got %d", len(tc.expect), len(archives))
+			}
+
+			for i, idx := range tc.expect {
+				if archives[i].ID != ids[idx] {
+					t.Errorf("archive %d: expected %s, got %s", i, ids[idx], archives[i].ID)
+				}
+			}
+
+			// metas go with their archives
+			for i, id := range ids {
+				kept := false
+				for _, idx := range tc.expect {
+					kept = kept || idx == i
+				}
+
+				_, err := os.Stat(archiveMetaPath(id))
+				if hasMeta := err == nil; hasMeta != (kept && i%2 == 0) {
+					t.Errorf("archive %d: meta present: %v", i, hasMeta)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+var auditLog = &auditLogger{}
+
+// auditEntry is a record of an admin or secret-touching operation.
+type auditEntry struct {
+	Time     time.Time
+	Identity string
+	Remote   string
+	Route    string
+	Action   string
+	Cluster  string   `json:",omitempty"`
+	CA       string   `json:",omitempty"`
+	Host     string   `json:",omitempty"`
+	Password string   `json:",omitempty"`
+	Token    string   `json:",omitempty"`
+	Secrets  []string `json:",omitempty"`
+	Result   string
+}
+
+// auditLogger appends entries to the audit log file, one JSON object per line.
+type auditLogger struct {
+	l sync.Mutex
+}
+
+func auditLogPath() string {
+	return filepath.Join(*dataDir, "audit.log")
+}
+
+func (a *auditLogger) Record(entry auditEntry) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	ba, err := json.Marshal(entry)
+	if err != nil {
+		log.Print("audit: failed to encode entry: ", err)
+		return
+	}
+
+	f, err := os.OpenFile(auditLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Print("audit: failed to open the log: ", err)
+		return
+	}
+
+	defer f.Close()
+
+	if _, err = f.Write(append(ba, '\n')); err != nil {
+		log.Print("audit: failed to write entry: ", err)
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		log.Print("audit: failed to sync the log: ", err)
+	}
+}
+
+// Read returns up to limit entries starting at offset, and the total number of entries.
+func (a *auditLogger) Read(offset, limit int) (entries []auditEntry, total int, err error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	entries = make([]auditEntry, 0)
+
+	f, err := os.Open(auditLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		total++
+
+		if total <= offset || len(entries) >= limit {
+			continue
+		}
+
+		entry := auditEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return
+		}
+
+		entries = append(entries, entry)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// auditRequest records an operation done through the API.
+func auditRequest(req *restful.Request, entry auditEntry, err error) {
+	entry.Time = time.Now()
+	entry.Identity = requestIdentity(req)
+	entry.Remote = clientIP(req.Request)
+	entry.Route = req.Request.Method + " " + req.SelectedRoutePath()
+
+	if err != nil {
+		entry.Result = "error: " + err.Error()
+	} else {
+		entry.Result = "success"
+	}
+
+	auditLog.Record(entry)
+}
+
+func requestIdentity(req *restful.Request) string {
+	if cred := requestAdmin(req); cred != nil {
+		return "admin:" + cred.Name
+	}
+
+	if hostName, ok := req.Attribute("host-name").(string); ok {
+		return "host:" + hostName
+	}
+
+	if token := getToken(req); token != "" && token == *hostsToken {
+		return "hosts-token"
+	}
+
+	return "anonymous"
+}
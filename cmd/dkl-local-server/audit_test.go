@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+func TestAuditLogRead(t *testing.T) {
+	defer withDataDir(t)()
+
+	if entries, total, err := auditLog.Read(0, 10); err != nil || total != 0 || len(entries) != 0 {
+		t.Fatalf("unexpected result without log: %v, %d, %v", entries, total, err)
+	}
+
+	for i := 0; i < 5; i++ {
+		auditLog.Record(auditEntry{Action: fmt.Sprint("action-", i)})
+	}
+
+	for _, tc := range []struct {
+		offset, limit int
+		expect        []string
+	}{
+		{0, 2, []string{"action-0", "action-1"}},
+		{3, 10, []string{"action-3", "action-4"}},
+		{5, 10, []string{}},
+		{0, 0, []string{}},
+	} {
+		entries, total, err := auditLog.Read(tc.offset, tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if total != 5 {
+			t.Errorf("%d/%d: expected 5 entries in total, got %d", tc.offset, tc.limit, total)
+		}
+
+		actions := make([]string, 0, len(entries))
+		for _, e := range entries {
+			actions = append(actions, e.Action)
+		}
+
+		if strings.Join(actions, ",") != strings.Join(tc.expect, ",") {
+			t.Errorf("%d/%d: expected %v, got %v", tc.offset, tc.limit, tc.expect, actions)
+		}
+	}
+}
+
+func TestAuditRequest(t *testing.T) {
+	defer withDataDir(t)()
+	defer withTrustedProxies(t, "", "xff")()
+
+	ws := (&restful.WebService{}).Produces(restful.MIME_JSON)
+	ws.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		req.SetAttribute("admin", &adminCredential{Name: "ops"})
+		chain.ProcessFilter(req, resp)
+	})
+	ws.Route(ws.GET("/clusters/{cluster-name}/passwords/{password-name}").To(func(req *restful.Request, resp *restful.Response) {
+		auditRequest(req, auditEntry{
+			Action:   "password-read",
+			Cluster:  req.PathParameter("cluster-name"),
+			Password: req.PathParameter("password-name"),
+		}, nil)
+		auditRequest(req, auditEntry{Action: "password-read"}, errors.New("failed"))
+	}))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	r := httptest.NewRequest(http.MethodGet, "/clusters/c1/passwords/p1", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	c.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries, _, err := auditLog.Read(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+
+	e := entries[0]
+	if e.Identity != "admin:ops" || e.Remote != "10.0.0.1" || e.Route != "GET /clusters/{cluster-name}/passwords/{password-name}" ||
+		e.Cluster != "c1" || e.Password != "p1" || e.Result != "success" || e.Time.IsZero() {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	if r := entries[1].Result; r != "error: failed" {
+		t.Errorf("unexpected result: %q", r)
+	}
+}
+
+func TestWsAudit(t *testing.T) {
+	defer withDataDir(t)()
+
+	for i := 0; i < 3; i++ {
+		auditLog.Record(auditEntry{Action: fmt.Sprint("action-", i)})
+	}
+
+	ws := (&restful.WebService{}).Produces(restful.MIME_JSON)
+	ws.Route(ws.GET("/audit").To(wsAudit))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	for _, tc := range []struct {
+		query  string
+		status int
+		expect int
+	}{
+		{"", http.StatusOK, 3},
+		{"?offset=1&limit=1", http.StatusOK, 1},
+		{"?offset=-1", http.StatusBadRequest, 0},
+		{"?limit=x", http.StatusBadRequest, 0},
+	} {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/audit"+tc.query, nil))
+
+		if rec.Code != tc.status {
+			t.Errorf("%q: expected status %d, got %d", tc.query, tc.status, rec.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		page := auditPage{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+
+		if page.Total != 3 || len(page.Entries) != tc.expect {
+			t.Errorf("%q: unexpected page: %+v", tc.query, page)
+		}
+	}
+}
+
+func TestRenderSecretsUsed(t *testing.T) {
+	sd := newTestSecretData()
+	sd.SetPassword("c1", "p1", "secret")
+
+	ctx := &renderContext{Host: &localconfig.Host{Name: "h1"}, secrets: sd}
+	funcs := ctx.templateFuncs()
+
+	password := funcs["password"].(func(string, string) (string, error))
+
+	for i := 0; i < 2; i++ {
+		if p, err := password("c1", "p1"); err != nil || p != "secret" {
+			t.Fatalf("unexpected password: %q, %v", p, err)
+		}
+	}
+
+	// token and certificates are not secret material
+	funcs["token"].(func(string, string) (string, error))("c1", "t1")
+
+	ctx.useSecret("ca_key", "c1", "ca1")
+
+	if used := strings.Join(ctx.SecretsUsed(), ","); used != "ca_key c1/ca1,password c1/p1" {
+		t.Errorf("unexpected secrets used: %q", used)
+	}
+}
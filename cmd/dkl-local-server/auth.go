@@ -1,36 +1,153 @@
 package main
 
 import (
+	"crypto/subtle"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
+
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	hostsToken = flag.String("hosts-token", "", "Token to give to access /hosts (open is none)")
-	adminToken = flag.String("admin-token", "", "Token to give to access to admin actions (open is none)")
+	hostsToken      = flag.String("hosts-token", "", "Shared token to give to access /me (open is none), in addition to the hosts' own tokens")
+	adminToken      = flag.String("admin-token", "", "Token to give to access to admin actions (open is none and no -admin-tokens-file)")
+	adminTokensFile = flag.String("admin-tokens-file", "", "YAML file of named admin tokens with their scopes and clusters")
+
+	adminCredentials []*adminCredential
+)
+
+// Admin scopes
+const (
+	// scopeAll grants every scope
+	scopeAll = "admin"
+	// scopeRead allows host and cluster listing and details
+	scopeRead = "read"
+	// scopeArtifacts allows host artifact download and builds
+	scopeArtifacts = "artifacts"
+	// scopePasswordsRead allows reading cluster passwords
+	scopePasswordsRead = "passwords:read"
+	// scopePasswordsWrite allows setting cluster passwords
+	scopePasswordsWrite = "passwords:write"
+	// scopeTokensRead allows reading cluster tokens
+	scopeTokensRead = "tokens:read"
+	// scopeTokensWrite allows setting, rotating and deleting cluster tokens
+	scopeTokensWrite = "tokens:write"
+	// scopeConfigsRead allows reading the configuration and its archives
+	scopeConfigsRead = "configs:read"
+	// scopeConfigsWrite allows uploading or restoring the configuration
+	scopeConfigsWrite = "configs:write"
+	// scopeCAsWrite allows changing the CAs (ie: rotations)
+	scopeCAsWrite = "cas:write"
+	// scopeAuditRead allows reading the audit log
+	scopeAuditRead = "audit:read"
 )
 
-func authorizeHosts(r *http.Request) bool {
-	return authorizeToken(r, *hostsToken)
+// adminCredential is a named admin token, limited to some scopes and clusters.
+type adminCredential struct {
+	Name   string
+	Token  string
+	Scopes []string
+	// Clusters restricts the credential to these clusters (all if empty).
+	// A restricted credential is denied the hosts without a cluster.
+	Clusters []string
 }
 
-func authorizeAdmin(r *http.Request) bool {
-	return authorizeToken(r, *adminToken)
+func (c *adminCredential) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == scopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted tells if the credential is limited to some clusters.
+func (c *adminCredential) Restricted() bool {
+	return len(c.Clusters) != 0
 }
 
-func authorizeToken(r *http.Request, token string) bool {
-	if token == "" {
-		// access is open
+// AllowsHost checks the credential is allowed on the host's cluster. Restricted
+// credentials need the host placement, so they fail with errNoHostMeta on configs without it.
+// Hosts with no cluster are not allowed to restricted credentials.
+func (c *adminCredential) AllowsHost(hostName string) (allowed bool, err error) {
+	if !c.Restricted() {
+		return true, nil
+	}
+
+	meta, err := readHostMeta(hostName)
+	if err != nil {
+		return
+	}
+
+	return c.AllowsCluster(meta.Cluster), nil
+}
+
+func (c *adminCredential) AllowsCluster(cluster string) bool {
+	if !c.Restricted() {
 		return true
 	}
 
-	reqToken := r.Header.Get("Authorization")
+	if cluster == "" {
+		return false
+	}
 
-	return reqToken == "Bearer "+token
+	for _, allowed := range c.Clusters {
+		if allowed == cluster {
+			return true
+		}
+	}
+	return false
 }
 
-func forbidden(w http.ResponseWriter, r *http.Request) {
-	log.Printf("denied access to %s from %s", r.RequestURI, r.RemoteAddr)
-	http.Error(w, "Forbidden", http.StatusForbidden)
+func loadAdminCredentials() (err error) {
+	credentials := make([]*adminCredential, 0)
+
+	if *adminTokensFile != "" {
+		ba, err := ioutil.ReadFile(*adminTokensFile)
+		if err != nil {
+			return err
+		}
+
+		if err = yaml.UnmarshalStrict(ba, &credentials); err != nil {
+			return fmt.Errorf("%s: %v", *adminTokensFile, err)
+		}
+
+		for i, c := range credentials {
+			if c.Name == "" || c.Token == "" {
+				return fmt.Errorf("%s: credential %d: name and token are required", *adminTokensFile, i)
+			}
+		}
+	}
+
+	if *adminToken != "" {
+		credentials = append(credentials, &adminCredential{
+			Name:   "admin",
+			Token:  *adminToken,
+			Scopes: []string{scopeAll},
+		})
+	}
+
+	log.Printf("loaded %d admin credentials", len(credentials))
+
+	adminCredentials = credentials
+	return
+}
+
+// findAdminCredential returns the credential having the given token.
+// When no credential is defined, access is open.
+func findAdminCredential(token string) *adminCredential {
+	if len(adminCredentials) == 0 {
+		return &adminCredential{Name: "anonymous", Scopes: []string{scopeAll}}
+	}
+
+	var found *adminCredential
+	for _, c := range adminCredentials {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+			found = c
+		}
+	}
+
+	return found
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// withAdminCredentials uses the credentials, returning a function restoring the previous ones.
+func withAdminCredentials(creds ...*adminCredential) (restore func()) {
+	prev := adminCredentials
+	adminCredentials = creds
+
+	return func() { adminCredentials = prev }
+}
+
+func TestLoadAdminCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		yaml       string
+		adminToken string
+		expect     []string
+		error      string
+	}{
+		{name: "none"},
+		{
+			name: "file",
+			yaml: `
+- name: reader
+  token: r
+  scopes: [read]
+- name: ops
+  token: o
+  scopes: [read, passwords:read]
+  clusters: [c1]
+`,
+			expect: []string{"reader", "ops"},
+		},
+		{
+			name:       "file and admin token",
+			yaml:       "[{name: reader, token: r, scopes: [read]}]",
+			adminToken: "a",
+			expect:     []string{"reader", "admin"},
+		},
+		{name: "admin token", adminToken: "a", expect: []string{"admin"}},
+		{name: "no token", yaml: "[{name: reader, scopes: [read]}]", error: "name and token are required"},
+		{name: "no name", yaml: "[{token: r}]", error: "name and token are required"},
+		{name: "unknown field", yaml: "[{name: reader, token: r, scope: [read]}]", error: "not found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer withAdminCredentials()()
+
+			prevFile, prevToken := *adminTokensFile, *adminToken
+			defer func() { *adminTokensFile, *adminToken = prevFile, prevToken }()
+
+			*adminTokensFile, *adminToken = "", tc.adminToken
+
+			if tc.yaml != "" {
+				f, err := ioutil.TempFile("", "admin-tokens")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.Remove(f.Name())
+
+				f.WriteString(tc.yaml)
+				f.Close()
+
+				*adminTokensFile = f.Name()
+			}
+
+			err := loadAdminCredentials()
+
+			if tc.error != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.error) {
+					t.Errorf("expected an error containing %q, got %v", tc.error, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := make([]string, 0, len(adminCredentials))
+			for _, c := range adminCredentials {
+				names = append(names, c.Name)
+			}
+
+			if strings.Join(names, ",") != strings.Join(tc.expect, ",") {
+				t.Errorf("expected credentials %v, got %v", tc.expect, names)
+			}
+		})
+	}
+}
+
+func TestFindAdminCredential(t *testing.T) {
+	restore := withAdminCredentials()
+
+	// open access
+	if c := findAdminCredential(""); c == nil || !c.HasScope(scopeConfigsWrite) {
+		t.Errorf("unexpected open access credential: %+v", c)
+	}
+
+	restore()
+
+	defer withAdminCredentials(
+		&adminCredential{Name: "a", Token: "token-a"},
+		&adminCredential{Name: "b", Token: "token-b"},
+	)()
+
+	for token, expect := range map[string]string{
+		"token-a": "a",
+		"token-b": "b",
+		"token-c": "",
+		"":        "",
+	} {
+		name := ""
+		if c := findAdminCredential(token); c != nil {
+			name = c.Name
+		}
+
+		if name != expect {
+			t.Errorf("%q: expected credential %q, got %q", token, expect, name)
+		}
+	}
+}
+
+func TestAdminCredentialScopes(t *testing.T) {
+	admin := &adminCredential{Scopes: []string{scopeAll}}
+	reader := &adminCredential{Scopes: []string{scopeRead, scopePasswordsRead}, Clusters: []string{"c1"}}
+
+	for _, scope := range []string{scopeRead, scopePasswordsWrite, scopeConfigsWrite} {
+		if !admin.HasScope(scope) {
+			t.Errorf("admin: missing scope %s", scope)
+		}
+	}
+
+	if !reader.HasScope(scopePasswordsRead) || reader.HasScope(scopePasswordsWrite) || reader.HasScope(scopeAll) {
+		t.Error("reader: unexpected scopes")
+	}
+
+	if !admin.AllowsCluster("c2") || admin.Restricted() {
+		t.Error("admin restricted")
+	}
+
+	if !reader.AllowsCluster("c1") || reader.AllowsCluster("c2") || reader.AllowsCluster("") {
+		t.Error("reader: unexpected clusters")
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	defer withConfig(t)()
+
+	writeTestConfig(t, `
+hosts: [{name: h1}, {name: h2}, {name: h3}]
+host_meta:
+  h1: {cluster: c1}
+  h2: {cluster: c2}
+`)
+
+	defer withAdminCredentials(
+		&adminCredential{Name: "admin", Token: "admin", Scopes: []string{scopeAll}},
+		&adminCredential{Name: "c1-reader", Token: "c1-reader", Scopes: []string{scopeRead, scopePasswordsRead}, Clusters: []string{"c1"}},
+		&adminCredential{Name: "reader", Token: "reader", Scopes: []string{scopeRead}},
+	)()
+
+	ok := func(req *restful.Request, resp *restful.Response) { resp.Write([]byte("ok")) }
+
+	ws := (&restful.WebService{}).Produces(restful.MIME_JSON)
+	ws.Filter(adminAuth)
+	ws.Route(ws.GET("/hosts").To(ok).Filter(requireGlobalScope(scopeRead)))
+	ws.Route(ws.GET("/hosts/{host-name}").To(ok).Filter(requireScope(scopeRead)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/passwords/{password-name}").To(ok).Filter(requireScope(scopePasswordsRead)))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	for _, tc := range []struct {
+		token, path string
+		status      int
+	}{
+		{"admin", "/hosts", http.StatusOK},
+		{"reader", "/hosts", http.StatusOK},
+		{"c1-reader", "/hosts", http.StatusForbidden},
+		{"bad", "/hosts", http.StatusUnauthorized},
+		{"", "/hosts", http.StatusUnauthorized},
+
+		{"c1-reader", "/hosts/h1", http.StatusOK},
+		{"c1-reader", "/hosts/h2", http.StatusForbidden},
+		// hosts without cluster are denied to restricted credentials
+		{"c1-reader", "/hosts/h3", http.StatusForbidden},
+		{"reader", "/hosts/h2", http.StatusOK},
+
+		{"c1-reader", "/clusters/c1/passwords/p1", http.StatusOK},
+		{"c1-reader", "/clusters/c2/passwords/p1", http.StatusForbidden},
+		{"reader", "/clusters/c1/passwords/p1", http.StatusForbidden},
+		{"admin", "/clusters/c2/passwords/p1", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, r)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.token, tc.path, tc.status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	backupTo        = flag.String("backup", "", "Write a backup of the server state to this file (- for stdout), then exit")
+	backupDist      = flag.Bool("backup-dist", false, "Include the dist files in the backups made with -backup")
+	backupRecipient = flag.String("backup-recipient", "", "RSA public key (PEM) to encrypt the backups' secrets to")
+)
+
+const (
+	backupVersion = 1
+
+	backupManifestName       = "manifest.json"
+	backupSecretsName        = "secret-data.json"
+	backupSecretsEncName     = "secret-data.json.enc"
+	backupSecretsEncryption  = "RSA-OAEP-SHA256+AES-256-GCM"
+	backupSecretsKeyIDLength = 8
+)
+
+// backupManifest lists the backup's files with their checksums, it's the archive's last entry.
+type backupManifest struct {
+	Version int
+	Time    time.Time
+	// SecretsKeyID identifies the recipient key the secrets are encrypted to, if any
+	SecretsKeyID string `json:",omitempty"`
+	Files        []backupFile
+}
+
+type backupFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// backupSecrets is the secret data encrypted to the backup's recipient.
+type backupSecrets struct {
+	Encryption string
+	KeyID      string
+	// Key is the data key, encrypted to the recipient
+	Key   []byte
+	Nonce []byte
+	Data  []byte
+}
+
+type backupWriter struct {
+	tw       *tar.Writer
+	manifest *backupManifest
+}
+
+func (w *backupWriter) add(name string, mode int64, modTime time.Time, content io.Reader, size int64) (err error) {
+	err = w.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return
+	}
+
+	h := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(w.tw, h), content)
+	if err != nil {
+		return
+	}
+
+	if n != size {
+		return fmt.Errorf("%s: size changed while being backed up", name)
+	}
+
+	w.manifest.Files = append(w.manifest.Files, backupFile{
+		Path:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	})
+	return
+}
+
+func (w *backupWriter) addBytes(name string, ba []byte) error {
+	return w.add(name, 0600, time.Now(), bytes.NewReader(ba), int64(len(ba)))
+}
+
+// backupSnapshot are the data dir's files to back up, opened: once opened,
+// they're read as they were even if they're replaced (the config, its meta and
+// archives are replaced by renames, never written in place).
+type backupSnapshot struct {
+	files []snapshotFile
+	// secrets is the secret data, in its stored form (so encrypted at rest if it is)
+	secrets []byte
+}
+
+type snapshotFile struct {
+	name string
+	f    *os.File
+	info os.FileInfo
+}
+
+// snapshotBackupFiles opens the files to back up and loads the secret data,
+// holding the config files lock so the config, its meta and its archives are
+// consistent (backups are made by another process than the server's).
+func snapshotBackupFiles(withDist bool) (s *backupSnapshot, err error) {
+	unlock, err := lockConfigFiles(false)
+	if err != nil {
+		return
+	}
+
+	defer unlock()
+
+	s = &backupSnapshot{}
+
+	defer func() {
+		if err != nil {
+			s.Close()
+			s = nil
+		}
+	}()
+
+	for _, name := range []string{"config.yaml", "config.meta.json"} {
+		if err = s.addFile(name); err != nil {
+			return
+		}
+	}
+
+	dirs := []string{"archives"}
+	if withDist {
+		dirs = append(dirs, "dist")
+	}
+
+	for _, dir := range dirs {
+		if err = s.addDir(dir); err != nil {
+			return
+		}
+	}
+
+	s.secrets, err = secretStorage.Load()
+	return
+}
+
+// addFile adds a file of the data dir, if it exists.
+func (s *backupSnapshot) addFile(name string) (err error) {
+	f, err := os.Open(filepath.Join(*dataDir, filepath.FromSlash(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	s.files = append(s.files, snapshotFile{name, f, stat})
+	return
+}
+
+// addDir adds the regular files of a data dir's directory, ignoring temporary files.
+func (s *backupSnapshot) addDir(dir string) error {
+	root := filepath.Join(*dataDir, dir)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && path != root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(*dataDir, path)
+		if err != nil {
+			return err
+		}
+
+		return s.addFile(filepath.ToSlash(rel))
+	})
+
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+func (s *backupSnapshot) Close() {
+	for _, file := range s.files {
+		file.f.Close()
+	}
+}
+
+// writeBackup writes a backup of the server state as a tar.gz stream.
+// The secrets are encrypted to the recipient if it's not nil.
+func writeBackup(out io.Writer, withDist bool, recipient *rsa.PublicKey) (err error) {
+	snapshot, err := snapshotBackupFiles(withDist)
+	if err != nil {
+		return
+	}
+
+	defer snapshot.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	w := &backupWriter{
+		tw: tw,
+		manifest: &backupManifest{
+			Version: backupVersion,
+			Time:    time.Now(),
+			Files:   make([]backupFile, 0),
+		},
+	}
+
+	for _, file := range snapshot.files {
+		err = w.add(file.name, int64(file.info.Mode().Perm()), file.info.ModTime(), file.f, file.info.Size())
+		if err != nil {
+			return
+		}
+	}
+
+	if secrets := snapshot.secrets; secrets != nil {
+		if recipient == nil {
+			err = w.addBytes(backupSecretsName, secrets)
+
+		} else {
+			var enc []byte
+			enc, err = encryptBackupSecrets(secrets, recipient)
+			if err != nil {
+				return
+			}
+
+			w.manifest.SecretsKeyID = backupKeyID(recipient)
+			err = w.addBytes(backupSecretsEncName, enc)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	manifest, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0600,
+		Size:    int64(len(manifest)),
+		ModTime: w.manifest.Time,
+	})
+	if err != nil {
+		return
+	}
+
+	if _, err = tw.Write(manifest); err != nil {
+		return
+	}
+
+	if err = tw.Close(); err != nil {
+		return
+	}
+
+	return gz.Close()
+}
+
+// backupToFile runs the -backup CLI mode.
+func backupToFile(path string) (err error) {
+	recipient, err := backupRecipientKey()
+	if err != nil {
+		return
+	}
+
+	if path == "-" {
+		return writeBackup(os.Stdout, *backupDist, recipient)
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(out.Name())
+
+	err = writeBackup(out, *backupDist, recipient)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+
+	return os.Rename(out.Name(), path)
+}
+
+// backupRecipientKey returns the -backup-recipient key, or nil if none is set.
+func backupRecipientKey() (*rsa.PublicKey, error) {
+	if *backupRecipient == "" {
+		return nil, nil
+	}
+
+	return readBackupRecipient(*backupRecipient)
+}
+
+func readBackupRecipient(path string) (pub *rsa.PublicKey, err error) {
+	ba, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	block, _ := pem.Decode(ba)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var key interface{}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key (%T)", path, key)
+	}
+
+	return
+}
+
+func backupKeyID(pub *rsa.PublicKey) string {
+	h := sha256.Sum256(x509.MarshalPKCS1PublicKey(pub))
+	return hex.EncodeToString(h[:backupSecretsKeyIDLength])
+}
+
+func encryptBackupSecrets(plain []byte, recipient *rsa.PublicKey) (ba []byte, err error) {
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient, key, []byte(backupSecretsName))
+	if err != nil {
+		return
+	}
+
+	return json.Marshal(backupSecrets{
+		Encryption: backupSecretsEncryption,
+		KeyID:      backupKeyID(recipient),
+		Key:        wrappedKey,
+		Nonce:      nonce,
+		Data:       aead.Seal(nil, nonce, plain, []byte(backupSecretsName)),
+	})
+}
+
+func decryptBackupSecrets(ba []byte, priv *rsa.PrivateKey) (plain []byte, err error) {
+	enc := backupSecrets{}
+	if err = json.Unmarshal(ba, &enc); err != nil {
+		return
+	}
+
+	if enc.Encryption != backupSecretsEncryption {
+		return nil, fmt.Errorf("unsupported backup secrets encryption: %q", enc.Encryption)
+	}
+
+	if priv == nil {
+		return nil, errors.New("the backup's secrets are encrypted, a key is required")
+	}
+
+	if id := backupKeyID(&priv.PublicKey); id != enc.KeyID {
+		return nil, fmt.Errorf("the backup's secrets are encrypted to key %s, not to the given key (%s)", enc.KeyID, id)
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, enc.Key, []byte(backupSecretsName))
+	if err != nil {
+		return
+	}
+
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return
+	}
+
+	return aead.Open(nil, enc.Nonce, enc.Data, []byte(backupSecretsName))
+}
+
+func backupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
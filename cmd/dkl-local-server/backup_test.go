@@ -0,0 +1,420 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testBackupEntry struct {
+	name    string
+	content string
+	typ     byte
+}
+
+// newTestBackup returns a backup of the entries, with a manifest listing them unless noManifest is set.
+func newTestBackup(t *testing.T, entries []testBackupEntry, noManifest bool) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	manifest := &backupManifest{Version: backupVersion, Time: time.Now()}
+
+	write := func(e testBackupEntry) {
+		typ := e.typ
+		if typ == 0 {
+			typ = tar.TypeReg
+		}
+
+		err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: typ, Mode: 0600, Size: int64(len(e.content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, e := range entries {
+		write(e)
+
+		h := sha256.Sum256([]byte(e.content))
+		manifest.Files = append(manifest.Files, backupFile{
+			Path:   e.name,
+			Size:   int64(len(e.content)),
+			SHA256: hex.EncodeToString(h[:]),
+		})
+	}
+
+	if !noManifest {
+		ba, _ := json.Marshal(manifest)
+		write(testBackupEntry{name: backupManifestName, content: string(ba)})
+	}
+
+	tw.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+func TestValidBackupPath(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"config.yaml":               true,
+		"config.meta.json":          true,
+		backupSecretsName:           true,
+		backupSecretsEncName:        true,
+		"archives/01ABC.yaml.gz":    true,
+		"dist/vmlinuz":              true,
+		"cache/x":                   false,
+		"audit.log":                 false,
+		"../config.yaml":            false,
+		"archives/../../etc/passwd": false,
+		"archives/../config.yaml":   false,
+		"/etc/passwd":               false,
+		"./config.yaml":             false,
+		"dist//vmlinuz":             false,
+		"":                          false,
+	} {
+		if validBackupPath(name) != valid {
+			t.Errorf("%q: expected valid=%v", name, valid)
+		}
+	}
+}
+
+func TestExtractBackup(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		backup  func(t *testing.T) []byte
+		error   string
+		extract int
+	}{
+		{
+			name: "valid",
+			backup: func(t *testing.T) []byte {
+				return newTestBackup(t, []testBackupEntry{
+					{name: "config.yaml", content: "hosts: []\n"},
+					{name: "archives/a.yaml.gz", content: "archive"},
+				}, false)
+			},
+			extract: 2,
+		},
+		{
+			name: "path traversal",
+			backup: func(t *testing.T) []byte {
+				return newTestBackup(t, []testBackupEntry{{name: "../escaped", content: "x"}}, false)
+			},
+			error: "unexpected file",
+		},
+		{
+			name: "path traversal in a dir",
+			backup: func(t *testing.T) []byte {
+				return newTestBackup(t, []testBackupEntry{{name: "archives/../../escaped", content: "x"}}, false)
+			},
+			error: "unexpected file",
+		},
+		{
+			name: "symlink",
+			backup: func(t *testing.T) []byte {
+				return newTestBackup(t, []testBackupEntry{{name: "config.yaml", typ: tar.TypeSymlink}}, false)
+			},
+			error: "not a regular file",
+		},
+		{
+			name: "duplicate",
+			backup: func(t *testing.T) []byte {
+				return newTestBackup(t, []testBackupEntry{
+					{name: "config.yaml", content: "a"},
+					{name: "config.yaml", content: "b"},
+				}, false)
+			},
+			error: "duplicate",
+		},
+		{
+			name: "no manifest",
+			backup: func(t *testing.T) []byte {
+				return newTestBackup(t, []testBackupEntry{{name: "config.yaml", content: "a"}}, true)
+			},
+			error: "no manifest",
+		},
+		{
+			name: "truncated",
+			backup: func(t *testing.T) []byte {
+				ba := newTestBackup(t, []testBackupEntry{
+					{name: "config.yaml", content: strings.Repeat("hosts: []\n", 1000)},
+				}, false)
+				return ba[:len(ba)/2]
+			},
+			error: "EOF",
+		},
+		{
+			name: "not a backup",
+			backup: func(t *testing.T) []byte {
+				return []byte("not a gzip stream, only text")
+			},
+			error: "header",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dkl-local-server-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			staging := filepath.Join(dir, "staging")
+			os.Mkdir(staging, 0700)
+
+			manifest, files, err := extractBackup(bytes.NewReader(tc.backup(t)), staging)
+
+			if tc.error != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.error) {
+					t.Errorf("expected an error containing %q, got %v", tc.error, err)
+				}
+
+				if _, err := os.Stat(filepath.Join(dir, "escaped")); err == nil {
+					t.Error("file extracted out of the staging dir")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(files) != tc.extract {
+				t.Errorf("expected %d files, got %d", tc.extract, len(files))
+			}
+
+			if err = verifyBackup(manifest, files); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	config := backupFile{Path: "config.yaml", Size: 3, SHA256: "abc"}
+	archive := backupFile{Path: "archives/a", Size: 3, SHA256: "def"}
+
+	for _, tc := range []struct {
+		name   string
+		listed []backupFile
+		files  []backupFile
+		error  string
+	}{
+		{"valid", []backupFile{config, archive}, []backupFile{config, archive}, ""},
+		{"missing", []backupFile{config, archive}, []backupFile{config}, "archives/a is missing"},
+		{"altered", []backupFile{config}, []backupFile{{Path: "config.yaml", Size: 3, SHA256: "xyz"}}, "checksum"},
+		{"extra", []backupFile{config}, []backupFile{config, archive}, "not in the manifest"},
+		{"no config", []backupFile{archive}, []backupFile{archive}, "no config"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]backupFile{}
+			for _, f := range tc.files {
+				files[f.Path] = f
+			}
+
+			err := verifyBackup(&backupManifest{Files: tc.listed}, files)
+
+			if tc.error == "" {
+				if err != nil {
+					t.Error(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.error) {
+				t.Errorf("expected an error containing %q, got %v", tc.error, err)
+			}
+		})
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	initUlid()
+
+	defer withSecretStore(t, newTestSecretKey(t))()
+	defer func() {
+		// the restore leaves the previous data dir next to it
+		previous, _ := filepath.Glob(*dataDir + ".before-restore-*")
+		for _, dir := range previous {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	write := func(name, content string) {
+		path := filepath.Join(*dataDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		ba, _ := ioutil.ReadFile(filepath.Join(*dataDir, name))
+		return string(ba)
+	}
+
+	write("config.yaml", "hosts: []\n")
+	write("archives/01ABC.yaml.gz", "archive")
+
+	secrets, err := encodeSecretData([]byte(`{"Version":2,"Clusters":{"c1":{"Tokens":{"t1":"abc"}}}}`), secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = secretStorage.Save(secrets); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := &bytes.Buffer{}
+	if err = writeBackup(backup, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes after the backup
+	write("config.yaml", "hosts: [changed]\n")
+	write("archives/01DEF.yaml.gz", "newer archive")
+	write("cache/entry", "cached")
+	write("audit.log", "audited\n")
+	secretStorage.Save([]byte(`{"Version":2}`))
+
+	backupFile := filepath.Join(*dataDir, "..", filepath.Base(*dataDir)+".backup")
+	if err = ioutil.WriteFile(backupFile, backup.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(backupFile)
+
+	if err = restoreBackup(backupFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := read("config.yaml"); c != "hosts: []\n" {
+		t.Errorf("config not restored: %q", c)
+	}
+	if _, err := os.Stat(filepath.Join(*dataDir, "archives", "01DEF.yaml.gz")); err == nil {
+		t.Error("archive not in the backup still present")
+	}
+
+	// not part of backups, kept
+	if read("cache/entry") != "cached" || read("audit.log") != "audited\n" {
+		t.Error("cache or audit log not kept")
+	}
+
+	data, _, err := readStoredSecretData(secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Clusters["c1"].Tokens["t1"] != "abc" {
+		t.Error("secret data not restored")
+	}
+}
+
+func TestSwapDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkl-local-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataPath := filepath.Join(dir, "data")
+	staging := filepath.Join(dir, "staging")
+	previous := filepath.Join(dir, "previous")
+
+	os.Mkdir(dataPath, 0700)
+	ioutil.WriteFile(filepath.Join(dataPath, "live"), nil, 0600)
+
+	// the staging dir can't be moved (missing): the data dir must be put back
+	if err = swapDataDir(dataPath, staging, previous); err == nil {
+		t.Fatal("no error")
+	}
+
+	if _, err = os.Stat(filepath.Join(dataPath, "live")); err != nil {
+		t.Fatal("data dir not put back: ", err)
+	}
+
+	os.Mkdir(staging, 0700)
+	ioutil.WriteFile(filepath.Join(staging, "restored"), nil, 0600)
+
+	if err = swapDataDir(dataPath, staging, previous); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(dataPath, "restored"),
+		filepath.Join(previous, "live"),
+	} {
+		if _, err = os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSnapshotLocksConfigFiles(t *testing.T) {
+	defer withSecretStore(t, newTestSecretKey(t))()
+
+	if err := ioutil.WriteFile(configFilePath(), []byte("hosts: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := secretStorage.Save([]byte("secrets")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a config write in progress, possibly in another process
+	unlock, err := lockConfigFiles(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *backupSnapshot, 1)
+	go func() {
+		s, err := snapshotBackupFiles(false)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- s
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("snapshot made during a config write")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+
+	var s *backupSnapshot
+	select {
+	case s = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("snapshot not made after the config write")
+	}
+
+	if s == nil {
+		return
+	}
+
+	defer s.Close()
+
+	if len(s.files) != 1 || s.files[0].name != "config.yaml" || string(s.secrets) != "secrets" {
+		t.Errorf("unexpected snapshot: %+v", s)
+	}
+
+	// backups don't exclude each other
+	unlock, err = lockConfigFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unlock()
+
+	other, err := snapshotBackupFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+}
@@ -81,6 +81,9 @@ func setupBootImage(bootImg *os.File, ctx *renderContext) (err error) {
 		return
 	}
 
+	release := loopBuilds.acquire("boot.img")
+	defer release()
+
 	devb, err := exec.Command("losetup", "--find", "--show", "--partscan", bootImg.Name()).CombinedOutput()
 	if err != nil {
 		return
@@ -11,6 +11,9 @@ import (
 )
 
 func buildBootISO(out io.Writer, ctx *renderContext) error {
+	release := isoBuilds.acquire("boot.iso")
+	defer release()
+
 	tempDir, err := ioutil.TempDir("/tmp", "iso-")
 	if err != nil {
 		return err
@@ -125,6 +128,16 @@ menuentry "Direktil" {
 
 	ioutil.WriteFile(filepath.Join(tempDir, "config.yaml"), cfgBytes, 0600)
 
+	// host identity
+	hostFiles, err := ctx.hostFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range hostFiles {
+		ioutil.WriteFile(filepath.Join(tempDir, f.Name), f.Content, 0600)
+	}
+
 	// kernel and initrd
 	type distCopy struct {
 		Src []string
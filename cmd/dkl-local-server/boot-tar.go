@@ -37,6 +37,16 @@ func buildBootTar(out io.Writer, ctx *renderContext) (err error) {
 
 	archAdd("config.yaml", cfgBytes)
 
+	// host identity
+	hostFiles, err := ctx.hostFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range hostFiles {
+		archAdd(f.Name, f.Content)
+	}
+
 	// add "current" elements
 	type distCopy struct {
 		Src []string
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+var (
+	maxLoopBuilds = flag.Int("max-loop-builds", 4, "Maximum concurrent builds using a loop device (0 is unlimited)")
+	maxISOBuilds  = flag.Int("max-iso-builds", 2, "Maximum concurrent ISO image builds (0 is unlimited)")
+
+	loopBuilds buildLimiter
+	isoBuilds  buildLimiter
+)
+
+// buildLimiter caps the number of concurrent builds of a kind. A nil limiter is unlimited.
+type buildLimiter chan struct{}
+
+func newBuildLimiter(max int) buildLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(buildLimiter, max)
+}
+
+func setupBuildLimits() {
+	loopBuilds = newBuildLimiter(*maxLoopBuilds)
+	isoBuilds = newBuildLimiter(*maxISOBuilds)
+}
+
+// acquire blocks until a build slot is available and returns its release function.
+func (l buildLimiter) acquire(what string) (release func()) {
+	if l == nil {
+		return func() {}
+	}
+
+	select {
+	case l <- struct{}{}:
+	default:
+		log.Printf("%s: waiting for a build slot (%d in use)", what, len(l))
+		l <- struct{}{}
+	}
+
+	return func() { <-l }
+}
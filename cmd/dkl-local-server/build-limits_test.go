@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"novit.nc/direktil/pkg/cas"
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+func TestBuildLimiter(t *testing.T) {
+	if l := newBuildLimiter(0); l != nil {
+		t.Error("limited with a max of 0")
+	}
+
+	// unlimited
+	var unlimited buildLimiter
+	unlimited.acquire("test")()
+
+	l := newBuildLimiter(2)
+
+	var running, maxRunning int32
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			defer l.acquire("test")()
+
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+
+	wg.Wait()
+
+	if maxRunning > 2 {
+		t.Errorf("%d builds ran concurrently", maxRunning)
+	}
+	if len(l) != 0 {
+		t.Errorf("%d slots not released", len(l))
+	}
+}
+
+// memCASStore is an in-memory cas.Store.
+type memCASStore struct {
+	l       sync.Mutex
+	entries map[string][]byte
+}
+
+var _ cas.Store = &memCASStore{}
+
+func (s *memCASStore) GetOrCreate(tag, item string, create func(io.Writer) error) (io.ReadSeeker, os.FileInfo, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	key := tag + "/" + item
+
+	if ba, ok := s.entries[key]; ok {
+		return bytes.NewReader(ba), nil, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := create(buf); err != nil {
+		return nil, nil, err
+	}
+
+	s.entries[key] = buf.Bytes()
+	return bytes.NewReader(buf.Bytes()), nil, nil
+}
+
+func (s *memCASStore) Tags() (tags []string, err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	seen := map[string]bool{}
+	for key := range s.entries {
+		tag := strings.SplitN(key, "/", 2)[0]
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return
+}
+
+func (s *memCASStore) Remove(tag string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	for key := range s.entries {
+		if strings.HasPrefix(key, tag+"/") {
+			delete(s.entries, key)
+		}
+	}
+
+	return nil
+}
+
+func TestGetOrBuild(t *testing.T) {
+	prev := casStore
+	defer func() { casStore = prev }()
+
+	casStore = &memCASStore{entries: map[string][]byte{}}
+
+	ctx := &renderContext{Host: &localconfig.Host{Name: "h1"}}
+
+	var builds int32
+	release := make(chan struct{})
+
+	create := func(out io.Writer, ctx *renderContext) error {
+		atomic.AddInt32(&builds, 1)
+		<-release
+		_, err := out.Write([]byte("built"))
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			content, _, err := ctx.getOrBuild("tag1", "boot.img", create)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if ba, _ := ioutil.ReadAll(content); string(ba) != "built" {
+				t.Errorf("unexpected content: %q", ba)
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if builds != 1 {
+		t.Errorf("built %d times", builds)
+	}
+
+	// other kinds are built separately
+	if _, _, err := ctx.getOrBuild("tag1", "boot.iso", create); err != nil {
+		t.Fatal(err)
+	}
+	if builds != 2 {
+		t.Errorf("built %d times", builds)
+	}
+
+	// failed builds are not kept
+	failed := errors.New("failed")
+	fail := func(out io.Writer, ctx *renderContext) error { return failed }
+
+	if _, _, err := ctx.getOrBuild("tag2", "boot.img", fail); err != failed {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err := ctx.getOrBuild("tag2", "boot.img", create); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/csr"
+	"github.com/cloudflare/cfssl/helpers"
+	"github.com/cloudflare/cfssl/initca"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	caConfigFile = flag.String("ca-config", "", "YAML file configuring the generation of new CAs (subject, key and validity) by cluster and CA name")
+
+	caConfig = &caGenerationConfig{}
+)
+
+const defaultCAExpiry = 5 * 365 * 24 * time.Hour
+
+// caGenerationConfig configures the generation of new CAs; existing CAs are not changed.
+type caGenerationConfig struct {
+	// Defaults applies to every CA
+	Defaults caSpec
+	// CAs applies to the matching CAs, the most specific ones last
+	CAs []caSpec
+}
+
+// caSpec is the specification of new CAs. Empty fields are inherited.
+type caSpec struct {
+	// Cluster and Name select the CAs (empty matches any)
+	Cluster string
+	Name    string
+
+	CN    string
+	Names []caSubjectName
+	// KeyAlgo is rsa, ecdsa or ed25519
+	KeyAlgo string `yaml:"key_algo"`
+	KeySize int    `yaml:"key_size"`
+	// Expiry is the CA's validity (ie: 87600h)
+	Expiry string
+}
+
+type caSubjectName struct {
+	C, ST, L, O, OU string
+}
+
+var defaultCASpec = caSpec{
+	CN: "Direktil Local Server",
+	Names: []caSubjectName{
+		{
+			C: "NC",
+			O: "novit.nc",
+		},
+	},
+	KeyAlgo: "ecdsa",
+	KeySize: 521, // 256, 384, 521
+}
+
+func loadCAConfig() (err error) {
+	if *caConfigFile == "" {
+		return
+	}
+
+	ba, err := ioutil.ReadFile(*caConfigFile)
+	if err != nil {
+		return
+	}
+
+	cfg := &caGenerationConfig{}
+	if err = yaml.UnmarshalStrict(ba, cfg); err != nil {
+		return fmt.Errorf("%s: %v", *caConfigFile, err)
+	}
+
+	// validate every spec caSpecFor can resolve: the specific specs, mixed with
+	// the ones for any cluster or name ("" matching none of the specific ones)
+	clusters, names := []string{""}, []string{""}
+	for _, spec := range cfg.CAs {
+		if spec.Cluster != "" {
+			clusters = append(clusters, spec.Cluster)
+		}
+		if spec.Name != "" {
+			names = append(names, spec.Name)
+		}
+	}
+
+	for _, cluster := range clusters {
+		for _, name := range names {
+			spec := cfg.specFor(cluster, name)
+
+			if err = spec.validate(); err != nil {
+				return fmt.Errorf("%s: CA spec for cluster %q, name %q: %v", *caConfigFile, cluster, name, err)
+			}
+		}
+	}
+
+	caConfig = cfg
+	return
+}
+
+func (spec *caSpec) merge(src caSpec) {
+	if src.CN != "" {
+		spec.CN = src.CN
+	}
+	if len(src.Names) != 0 {
+		spec.Names = src.Names
+	}
+	if src.KeyAlgo != "" && src.KeyAlgo != spec.KeyAlgo {
+		spec.KeyAlgo = src.KeyAlgo
+		spec.KeySize = 0
+	}
+	if src.KeySize != 0 {
+		spec.KeySize = src.KeySize
+	}
+	if src.Expiry != "" {
+		spec.Expiry = src.Expiry
+	}
+
+	if spec.KeySize == 0 {
+		switch spec.KeyAlgo {
+		case "rsa":
+			spec.KeySize = 2048
+		case "ecdsa":
+			spec.KeySize = 256
+		}
+	}
+}
+
+func (spec *caSpec) validate() error {
+	switch spec.KeyAlgo {
+	case "rsa":
+		if spec.KeySize < 2048 || spec.KeySize > 8192 {
+			return fmt.Errorf("invalid RSA key size: %d", spec.KeySize)
+		}
+	case "ecdsa":
+		switch spec.KeySize {
+		case 256, 384, 521:
+		default:
+			return fmt.Errorf("invalid ECDSA key size: %d", spec.KeySize)
+		}
+	case "ed25519":
+		if spec.KeySize != 0 {
+			return errors.New("ed25519 keys have no size")
+		}
+	default:
+		return fmt.Errorf("invalid key algorithm: %q", spec.KeyAlgo)
+	}
+
+	if _, err := spec.expiry(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (spec *caSpec) expiry() (time.Duration, error) {
+	if spec.Expiry == "" {
+		return defaultCAExpiry, nil
+	}
+
+	d, err := time.ParseDuration(spec.Expiry)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry: %v", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid expiry: %s", spec.Expiry)
+	}
+	return d, nil
+}
+
+// caSpecFor returns the spec of a new CA.
+func caSpecFor(cluster, name string) caSpec {
+	return caConfig.specFor(cluster, name)
+}
+
+func (cfg *caGenerationConfig) specFor(cluster, name string) (spec caSpec) {
+	spec = defaultCASpec
+	spec.merge(cfg.Defaults)
+
+	// apply the matching specs, the least specific first
+	for _, wantCluster := range []bool{false, true} {
+		for _, wantName := range []bool{false, true} {
+			for _, s := range cfg.CAs {
+				if (s.Cluster != "") != wantCluster || (s.Name != "") != wantName {
+					continue
+				}
+				if (s.Cluster != "" && s.Cluster != cluster) || (s.Name != "" && s.Name != name) {
+					continue
+				}
+
+				spec.merge(s)
+			}
+		}
+	}
+
+	return
+}
+
+// newCA generates a new CA for the cluster, following the CA config.
+func newCA(cluster, name string) (ca *CA, err error) {
+	spec := caSpecFor(cluster, name)
+
+	var cert, key []byte
+
+	if spec.KeyAlgo == "ed25519" {
+		cert, key, err = newEd25519CA(spec)
+
+	} else {
+		req := &csr.CertificateRequest{
+			CN: spec.CN,
+			KeyRequest: &csr.BasicKeyRequest{
+				A: spec.KeyAlgo,
+				S: spec.KeySize,
+			},
+			CA: &csr.CAConfig{
+				Expiry: spec.Expiry,
+			},
+		}
+
+		for _, n := range spec.Names {
+			req.Names = append(req.Names, csr.Name{C: n.C, ST: n.ST, L: n.L, O: n.O, OU: n.OU})
+		}
+
+		cert, _, key, err = initca.New(req)
+	}
+
+	if err != nil {
+		return
+	}
+
+	ca = &CA{
+		Key:    key,
+		Cert:   cert,
+		Signed: make(map[string]*KeyCert),
+	}
+
+	return
+}
+
+// newEd25519CA generates an Ed25519 CA, not supported by cfssl.
+func newEd25519CA(spec caSpec) (certPEM, keyPEM []byte, err error) {
+	expiry, err := spec.expiry()
+	if err != nil {
+		return
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return
+	}
+
+	subject := pkix.Name{CommonName: spec.CN}
+	for _, n := range spec.Names {
+		appendNonEmpty(&subject.Country, n.C)
+		appendNonEmpty(&subject.Province, n.ST)
+		appendNonEmpty(&subject.Locality, n.L)
+		appendNonEmpty(&subject.Organization, n.O)
+		appendNonEmpty(&subject.OrganizationalUnit, n.OU)
+	}
+
+	now := time.Now()
+
+	ski, err := subjectKeyID(pub)
+	if err != nil {
+		return
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		SubjectKeyId:          ski,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(expiry),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		return
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return
+}
+
+func appendNonEmpty(values *[]string, value string) {
+	if value != "" {
+		*values = append(*values, value)
+	}
+}
+
+// subjectKeyID returns the key identifier of a public key, computed like cfssl does.
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	spki := struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{}
+
+	if _, err = asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+
+	ski := sha1.Sum(spki.PublicKey.Bytes)
+	return ski[:], nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// ed25519Key returns the CA's key if it's an Ed25519 key, nil otherwise.
+func (ca *CA) ed25519Key() ed25519.PrivateKey {
+	block, _ := pem.Decode(ca.Key)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil
+	}
+
+	edKey, _ := key.(ed25519.PrivateKey)
+	return edKey
+}
+
+// sign signs a CSR with the CA, following the signing policy's profile.
+func (ca *CA) sign(policy *config.Signing, csrPEM []byte, profile, label string) (cert []byte, err error) {
+	if key := ca.ed25519Key(); key != nil {
+		return ca.signEd25519(key, policy, csrPEM, profile, label)
+	}
+
+	sgr, err := ca.Signer(policy)
+	if err != nil {
+		return
+	}
+
+	return sgr.Sign(signer.SignRequest{
+		Request: string(csrPEM),
+		Profile: profile,
+		Label:   label,
+	})
+}
+
+// signEd25519 signs with an Ed25519 CA, as cfssl's signer doesn't support them.
+// The profile is selected like cfssl's local signer does; so is the label, only
+// selecting a signer in multi-root setups, ignored.
+func (ca *CA) signEd25519(key ed25519.PrivateKey, policy *config.Signing, csrPEM []byte, profileName, label string) (certPEM []byte, err error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return nil, errors.New("invalid CSR")
+	}
+
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return
+	}
+
+	if err = req.CheckSignature(); err != nil {
+		return
+	}
+
+	caCert, err := helpers.ParseCertificatePEM(ca.Cert)
+	if err != nil {
+		return
+	}
+
+	var profile *config.SigningProfile
+	if policy != nil {
+		profile = policy.Default
+		if p, ok := policy.Profiles[profileName]; ok && profileName != "" {
+			profile = p
+		}
+	}
+
+	if profile == nil {
+		// cfssl's default, as used by its local signer without policy
+		profile = config.DefaultConfig()
+	}
+
+	keyUsage, extKeyUsage, _ := profile.Usages()
+
+	expiry := profile.Expiry
+	if expiry == 0 {
+		expiry = 365 * 24 * time.Hour
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return
+	}
+
+	ski, err := subjectKeyID(req.PublicKey)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               req.Subject,
+		DNSNames:              req.DNSNames,
+		IPAddresses:           req.IPAddresses,
+		EmailAddresses:        req.EmailAddresses,
+		URIs:                  req.URIs,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(expiry),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+		SubjectKeyId:          ski,
+		AuthorityKeyId:        caCert.SubjectKeyId,
+	}
+
+	if c := profile.CAConstraint; c.IsCA {
+		tmpl.IsCA = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		tmpl.MaxPathLen = c.MaxPathLen
+		tmpl.MaxPathLenZero = c.MaxPathLen == 0 && c.MaxPathLenZero
+	}
+
+	if tmpl.NotAfter.After(caCert.NotAfter) {
+		tmpl.NotAfter = caCert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, req.PublicKey, key)
+	if err != nil {
+		return
+	}
+
+	log.Infof("signed certificate with serial number %s (Ed25519 CA)", serial)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/helpers"
+)
+
+func TestCASpecMerge(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		src    caSpec
+		expect caSpec
+	}{
+		{
+			name:   "empty",
+			expect: defaultCASpec,
+		},
+		{
+			name:   "same algorithm keeps the size",
+			src:    caSpec{KeyAlgo: "ecdsa", CN: "test"},
+			expect: caSpec{CN: "test", Names: defaultCASpec.Names, KeyAlgo: "ecdsa", KeySize: 521},
+		},
+		{
+			name:   "other algorithm resets the size",
+			src:    caSpec{KeyAlgo: "rsa"},
+			expect: caSpec{CN: defaultCASpec.CN, Names: defaultCASpec.Names, KeyAlgo: "rsa", KeySize: 2048},
+		},
+		{
+			name:   "other algorithm and size",
+			src:    caSpec{KeyAlgo: "rsa", KeySize: 4096},
+			expect: caSpec{CN: defaultCASpec.CN, Names: defaultCASpec.Names, KeyAlgo: "rsa", KeySize: 4096},
+		},
+		{
+			name:   "ed25519 has no size",
+			src:    caSpec{KeyAlgo: "ed25519", Expiry: "1h"},
+			expect: caSpec{CN: defaultCASpec.CN, Names: defaultCASpec.Names, KeyAlgo: "ed25519", Expiry: "1h"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := defaultCASpec
+			spec.merge(tc.src)
+
+			if !caSpecsEqual(spec, tc.expect) {
+				t.Errorf("expected %+v, got %+v", tc.expect, spec)
+			}
+		})
+	}
+}
+
+func caSpecsEqual(a, b caSpec) bool {
+	if len(a.Names) != len(b.Names) {
+		return false
+	}
+	for i := range a.Names {
+		if a.Names[i] != b.Names[i] {
+			return false
+		}
+	}
+
+	a.Names, b.Names = nil, nil
+	return a.CN == b.CN && a.KeyAlgo == b.KeyAlgo && a.KeySize == b.KeySize && a.Expiry == b.Expiry
+}
+
+func TestCASpecFor(t *testing.T) {
+	cfg := &caGenerationConfig{
+		Defaults: caSpec{CN: "defaults", Expiry: "100h"},
+		CAs: []caSpec{
+			// the most specific first: the order must not matter
+			{Cluster: "c1", Name: "ca1", CN: "c1 ca1"},
+			{Cluster: "c1", CN: "c1", KeyAlgo: "rsa"},
+			{Name: "ca1", CN: "ca1", KeySize: 384, Expiry: "10h"},
+		},
+	}
+
+	for _, tc := range []struct {
+		cluster, name string
+		expect        caSpec
+	}{
+		{"c2", "ca2", caSpec{CN: "defaults", KeyAlgo: "ecdsa", KeySize: 521, Expiry: "100h"}},
+		{"c2", "ca1", caSpec{CN: "ca1", KeyAlgo: "ecdsa", KeySize: 384, Expiry: "10h"}},
+		{"c1", "ca2", caSpec{CN: "c1", KeyAlgo: "rsa", KeySize: 2048, Expiry: "100h"}},
+		{"c1", "ca1", caSpec{CN: "c1 ca1", KeyAlgo: "rsa", KeySize: 2048, Expiry: "10h"}},
+	} {
+		spec := cfg.specFor(tc.cluster, tc.name)
+		tc.expect.Names = defaultCASpec.Names
+
+		if !caSpecsEqual(spec, tc.expect) {
+			t.Errorf("%s/%s: expected %+v, got %+v", tc.cluster, tc.name, tc.expect, spec)
+		}
+	}
+}
+
+func TestLoadCAConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		yaml  string
+		error string
+	}{
+		{
+			name: "valid",
+			yaml: `
+defaults:
+  key_algo: ed25519
+cas:
+- cluster: c1
+  key_algo: rsa
+  key_size: 4096
+- name: ca1
+  expiry: 24h
+`,
+		},
+		{
+			name:  "invalid defaults",
+			yaml:  "defaults: {key_algo: dsa}",
+			error: "invalid key algorithm",
+		},
+		{
+			name:  "size without algorithm",
+			yaml:  "defaults: {key_algo: ed25519}\ncas: [{name: ca1, key_size: 384}]",
+			error: `name "ca1": ed25519 keys have no size`,
+		},
+		{
+			// each spec is valid with the defaults, but not both combined
+			name:  "invalid combination",
+			yaml:  "cas: [{cluster: c1, key_size: 384}, {name: ca1, key_algo: rsa}]",
+			error: `cluster "c1", name "ca1": invalid RSA key size: 384`,
+		},
+		{
+			name:  "invalid expiry",
+			yaml:  "cas: [{cluster: c1, expiry: -1h}]",
+			error: "invalid expiry",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "ca-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+
+			f.WriteString(tc.yaml)
+			f.Close()
+
+			prevFile, prevConfig := *caConfigFile, caConfig
+			defer func() { *caConfigFile, caConfig = prevFile, prevConfig }()
+
+			*caConfigFile = f.Name()
+
+			err = loadCAConfig()
+
+			if tc.error == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if caConfig == prevConfig {
+					t.Error("config not set")
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.error) {
+				t.Errorf("expected an error containing %q, got %v", tc.error, err)
+			}
+			if caConfig != prevConfig {
+				t.Error("invalid config set")
+			}
+		})
+	}
+}
+
+func newTestCSR(t *testing.T, cn string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: []string{cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestSignEd25519(t *testing.T) {
+	prev := caConfig
+	defer func() { caConfig = prev }()
+
+	caConfig = &caGenerationConfig{Defaults: caSpec{KeyAlgo: "ed25519"}}
+
+	ca, err := newCA("c1", "ca1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, err := helpers.ParseCertificatePEM(ca.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(caCert.SubjectKeyId) == 0 {
+		t.Error("CA without subject key ID")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		policy  *config.Signing
+		profile string
+		isCA    bool
+	}{
+		{name: "no policy"},
+		{name: "no default profile", policy: &config.Signing{}, profile: "server"},
+		{
+			name: "CA profile",
+			policy: &config.Signing{
+				Default: config.DefaultConfig(),
+				Profiles: map[string]*config.SigningProfile{
+					"ca": {CAConstraint: config.CAConstraint{IsCA: true, MaxPathLenZero: true}},
+				},
+			},
+			profile: "ca",
+			isCA:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			certPEM, err := ca.sign(tc.policy, newTestCSR(t, "test.example.com"), tc.profile, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cert, err := helpers.ParseCertificatePEM(certPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = cert.CheckSignatureFrom(caCert); err != nil {
+				t.Error(err)
+			}
+
+			if len(cert.SubjectKeyId) == 0 {
+				t.Error("no subject key ID")
+			}
+			if !bytes.Equal(cert.AuthorityKeyId, caCert.SubjectKeyId) {
+				t.Error("authority key ID is not the CA's subject key ID")
+			}
+
+			if cert.IsCA != tc.isCA {
+				t.Errorf("expected IsCA %v", tc.isCA)
+			}
+			if tc.isCA && (cert.MaxPathLen != 0 || !cert.MaxPathLenZero) {
+				t.Errorf("path length not constrained: %d", cert.MaxPathLen)
+			}
+
+			if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "test.example.com" {
+				t.Errorf("unexpected DNS names: %v", cert.DNSNames)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/cfssl/helpers"
+	"github.com/cloudflare/cfssl/log"
+)
+
+var errCAExists = errors.New("CA already exists")
+
+// caImport is an externally generated CA to import.
+type caImport struct {
+	// Key is the CA's PEM encoded private key
+	Key string
+	// Cert is the CA's PEM encoded certificate
+	Cert string
+	// Chain is the PEM encoded chain of the CA's certificate (its issuer first), if not self-signed.
+	// It may stop before the root, when the clients already trust an intermediate or the root.
+	Chain string
+}
+
+// caImportError is an invalid CA import.
+type caImportError struct {
+	msg string
+}
+
+func (e caImportError) Error() string {
+	return "invalid CA: " + e.msg
+}
+
+func caImportErrorf(format string, args ...interface{}) error {
+	return caImportError{fmt.Sprintf(format, args...)}
+}
+
+// validate checks the imported CA, returning it as a CA.
+// The chain's last certificate isn't required to be a root (self-signed): the
+// chain is only checked to link the CA's certificate to its last certificate.
+func (imp *caImport) validate() (ca *CA, err error) {
+	cert, err := helpers.ParseCertificatePEM([]byte(imp.Cert))
+	if err != nil {
+		return nil, caImportErrorf("bad certificate: %v", err)
+	}
+
+	key, err := helpers.ParsePrivateKeyPEM([]byte(imp.Key))
+	if err != nil {
+		return nil, caImportErrorf("bad key: %v", err)
+	}
+
+	keyPub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, caImportErrorf("bad key: %v", err)
+	}
+
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil || !bytes.Equal(keyPub, certPub) {
+		return nil, caImportErrorf("the key doesn't match the certificate")
+	}
+
+	now := time.Now()
+
+	if err = checkCACert(cert, now); err != nil {
+		return nil, caImportErrorf("certificate: %v", err)
+	}
+
+	var chain []*x509.Certificate
+	if imp.Chain != "" {
+		chain, err = helpers.ParseCertificatesPEM([]byte(imp.Chain))
+		if err != nil {
+			return nil, caImportErrorf("bad chain: %v", err)
+		}
+	}
+
+	// each certificate must be signed by the next one
+	prev := cert
+	for i, issuer := range chain {
+		if err = checkCACert(issuer, now); err != nil {
+			return nil, caImportErrorf("chain certificate %d: %v", i, err)
+		}
+
+		if err = prev.CheckSignatureFrom(issuer); err != nil {
+			return nil, caImportErrorf("chain certificate %d didn't sign the previous certificate: %v", i, err)
+		}
+
+		prev = issuer
+	}
+
+	if len(chain) == 0 && cert.CheckSignatureFrom(cert) != nil {
+		return nil, caImportErrorf("the certificate is not self-signed and no chain was given")
+	}
+
+	ca = &CA{
+		Key:      []byte(imp.Key),
+		Cert:     []byte(imp.Cert),
+		Chain:    []byte(imp.Chain),
+		Imported: true,
+		Signed:   make(map[string]*KeyCert),
+	}
+
+	// the CA must be usable by the signer
+	if _, err = ca.Signer(nil); err != nil {
+		return nil, caImportErrorf("can't sign with it: %v", err)
+	}
+
+	return
+}
+
+// pemBundle concatenates PEM encoded certificates, skipping the empty ones.
+func pemBundle(certs ...[]byte) []byte {
+	bundle := make([]byte, 0)
+
+	for _, cert := range certs {
+		if len(cert) == 0 {
+			continue
+		}
+
+		bundle = append(bundle, cert...)
+		if !bytes.HasSuffix(cert, []byte("\n")) {
+			bundle = append(bundle, '\n')
+		}
+	}
+
+	return bundle
+}
+
+// CertChain returns the certificate followed by the CA's certificate and chain,
+// or only the certificate if the CA has no chain (the CA being the root).
+func (ca *CA) CertChain(cert []byte) []byte {
+	if len(ca.Chain) == 0 {
+		return cert
+	}
+
+	return pemBundle(cert, ca.Cert, ca.Chain)
+}
+
+func checkCACert(cert *x509.Certificate, now time.Time) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return errors.New("not a CA")
+	}
+
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("not allowed to sign certificates")
+	}
+
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("not valid now (valid from %s to %s)", cert.NotBefore, cert.NotAfter)
+	}
+
+	return nil
+}
+
+// ImportCA adds an externally generated CA to the cluster.
+func (sd *SecretData) ImportCA(cluster, name string, ca *CA) error {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs := sd.cluster(cluster)
+
+	if _, ok := cs.CAs[name]; ok {
+		return errCAExists
+	}
+
+	log.Info("secret-data: imported CA in cluster ", cluster, ": ", name)
+
+	cs.CAs[name] = ca
+	sd.markChanged("ca", cluster, name)
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	keyPEM  []byte
+	certPEM []byte
+}
+
+// newTestCA returns a CA signed by the parent, or self-signed if parent is nil.
+func newTestCA(t *testing.T, name string, parent *testCA) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	issuer, issuerKey := tmpl, key
+	if parent != nil {
+		issuer, issuerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		key:     key,
+		cert:    cert,
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func TestCAImportValidate(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", root)
+	issuing := newTestCA(t, "issuing", intermediate)
+	other := newTestCA(t, "other", nil)
+
+	chain := func(cas ...*testCA) string {
+		certs := make([][]byte, 0, len(cas))
+		for _, ca := range cas {
+			certs = append(certs, ca.certPEM)
+		}
+		return string(pemBundle(certs...))
+	}
+
+	for _, tc := range []struct {
+		name  string
+		imp   caImport
+		error string
+	}{
+		{
+			name: "self-signed",
+			imp:  caImport{Key: string(root.keyPEM), Cert: string(root.certPEM)},
+		},
+		{
+			name: "with chain up to the root",
+			imp:  caImport{Key: string(issuing.keyPEM), Cert: string(issuing.certPEM), Chain: chain(intermediate, root)},
+		},
+		{
+			// the clients may trust the intermediate
+			name: "with chain stopping before the root",
+			imp:  caImport{Key: string(issuing.keyPEM), Cert: string(issuing.certPEM), Chain: chain(intermediate)},
+		},
+		{
+			name:  "without chain",
+			imp:   caImport{Key: string(intermediate.keyPEM), Cert: string(intermediate.certPEM)},
+			error: "not self-signed",
+		},
+		{
+			name:  "chain in the wrong order",
+			imp:   caImport{Key: string(issuing.keyPEM), Cert: string(issuing.certPEM), Chain: chain(root, intermediate)},
+			error: "didn't sign",
+		},
+		{
+			name:  "unrelated chain",
+			imp:   caImport{Key: string(intermediate.keyPEM), Cert: string(intermediate.certPEM), Chain: chain(other)},
+			error: "didn't sign",
+		},
+		{
+			name:  "key mismatch",
+			imp:   caImport{Key: string(other.keyPEM), Cert: string(root.certPEM)},
+			error: "doesn't match",
+		},
+		{
+			name:  "bad chain",
+			imp:   caImport{Key: string(issuing.keyPEM), Cert: string(issuing.certPEM), Chain: "not PEM"},
+			error: "bad chain",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ca, err := tc.imp.validate()
+
+			if tc.error == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ca.Imported || string(ca.Chain) != tc.imp.Chain {
+					t.Errorf("unexpected CA: %+v", ca)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.error) {
+				t.Errorf("expected an error containing %q, got %v", tc.error, err)
+			}
+		})
+	}
+}
+
+func TestPEMBundle(t *testing.T) {
+	if b := string(pemBundle([]byte("a\n"), nil, []byte("b"), []byte{})); b != "a\nb\n" {
+		t.Errorf("unexpected bundle: %q", b)
+	}
+
+	if b := pemBundle(); b == nil || len(b) != 0 {
+		t.Errorf("unexpected empty bundle: %q", b)
+	}
+}
+
+func TestCACertChain(t *testing.T) {
+	cert := []byte("cert\n")
+
+	// the CA is the root, it's not part of the chain
+	ca := &CA{Cert: []byte("ca\n")}
+	if chain := string(ca.CertChain(cert)); chain != "cert\n" {
+		t.Errorf("unexpected chain: %q", chain)
+	}
+
+	ca.Chain = []byte("intermediate\nroot\n")
+	if chain := string(ca.CertChain(cert)); chain != "cert\nca\nintermediate\nroot\n" {
+		t.Errorf("unexpected chain: %q", chain)
+	}
+}
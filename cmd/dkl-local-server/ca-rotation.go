@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// CA rotation phases
+const (
+	// caRotationGenerated: the successor CA exists but is not trusted yet
+	caRotationGenerated = "generated"
+	// caRotationBundled: the successor CA is trusted, the current one still signs
+	caRotationBundled = "bundled"
+	// caRotationSwitched: the successor CA signs, the previous one is still trusted
+	caRotationSwitched = "switched"
+)
+
+// CA rotation actions, moving to the next phase
+const (
+	caRotationGenerate = "generate"
+	caRotationBundle   = "bundle"
+	caRotationSwitch   = "switch"
+	caRotationRetire   = "retire"
+	caRotationCancel   = "cancel"
+)
+
+// CARotation is a CA rotation in progress.
+type CARotation struct {
+	Phase   string
+	Started time.Time
+	Updated time.Time
+
+	// Next is the successor CA, until switched
+	Next *CA `json:",omitempty"`
+	// Previous is the replaced CA, once switched
+	Previous *CA `json:",omitempty"`
+}
+
+// caRotationError is an action not allowed in the current rotation phase.
+type caRotationError struct {
+	Action string
+	Phase  string
+}
+
+func (e caRotationError) Error() string {
+	phase := e.Phase
+	if phase == "" {
+		phase = "none"
+	}
+	return fmt.Sprintf("CA rotation: can't %s in phase %s", e.Action, phase)
+}
+
+// Bundle returns the certificates to trust for this CA, ie with the successor or previous CA during a rotation.
+func (ca *CA) Bundle() []byte {
+	bundle := ca.Cert
+
+	if r := ca.Rotation; r != nil {
+		var other *CA
+
+		switch r.Phase {
+		case caRotationBundled:
+			other = r.Next
+		case caRotationSwitched:
+			other = r.Previous
+		}
+
+		if other != nil {
+			bundle = append(append(append([]byte{}, bundle...), '\n'), other.Cert...)
+		}
+	}
+
+	return bundle
+}
+
+// RotationPhase returns the CA's rotation phase, empty if not rotating.
+func (ca *CA) RotationPhase() string {
+	if ca.Rotation == nil {
+		return ""
+	}
+	return ca.Rotation.Phase
+}
+
+// RotateCA applies a rotation action to the cluster's CA.
+// The CA is not modified: it's replaced with the rotated one, which is returned.
+func (sd *SecretData) RotateCA(cluster, name, action string) (ca *CA, err error) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs, ok := sd.clusters[cluster]
+	if !ok {
+		return nil, nil
+	}
+
+	current := cs.CAs[name]
+	if current == nil {
+		return
+	}
+
+	phase := current.RotationPhase()
+	now := time.Now()
+
+	rotated := *current
+
+	var r *CARotation
+	if current.Rotation != nil {
+		rotation := *current.Rotation
+		r = &rotation
+	}
+
+	switch {
+	case action == caRotationGenerate && phase == "":
+		next, err := newCA(cluster, name)
+		if err != nil {
+			return nil, err
+		}
+
+		rotated.Rotation = &CARotation{
+			Phase:   caRotationGenerated,
+			Started: now,
+			Next:    next,
+		}
+
+	case action == caRotationBundle && phase == caRotationGenerated:
+		r.Phase = caRotationBundled
+		rotated.Rotation = r
+
+	case action == caRotationSwitch && phase == caRotationBundled:
+		r.Previous = &CA{
+			Key:      current.Key,
+			Cert:     current.Cert,
+			Chain:    current.Chain,
+			Imported: current.Imported,
+			Signed:   current.Signed,
+		}
+
+		rotated.Key = r.Next.Key
+		rotated.Cert = r.Next.Cert
+		rotated.Chain = r.Next.Chain
+		rotated.Imported = r.Next.Imported
+		rotated.Signed = r.Next.Signed
+		if rotated.Signed == nil {
+			rotated.Signed = make(map[string]*KeyCert)
+		}
+
+		r.Next = nil
+		r.Phase = caRotationSwitched
+		rotated.Rotation = r
+
+	case action == caRotationRetire && phase == caRotationSwitched:
+		rotated.Rotation = nil
+
+	case action == caRotationCancel && (phase == caRotationGenerated || phase == caRotationBundled):
+		rotated.Rotation = nil
+
+	default:
+		return nil, caRotationError{action, phase}
+	}
+
+	if rotated.Rotation != nil {
+		rotated.Rotation.Updated = now
+	}
+
+	ca = &rotated
+	cs.CAs[name] = ca
+
+	log.Infof("secret-data: cluster %s: CA %s: rotation %s, now in phase %q", cluster, name, action, ca.RotationPhase())
+
+	sd.markChanged("ca", cluster, name)
+	return
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/helpers"
+	restful "github.com/emicklei/go-restful"
+)
+
+// bundleCNs returns the common names of the certificates in the CA's bundle.
+func bundleCNs(t *testing.T, ca *CA) string {
+	certs, err := helpers.ParseCertificatesPEM(ca.Bundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cns := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		cns = append(cns, cert.Subject.CommonName)
+	}
+
+	return strings.Join(cns, ",")
+}
+
+func TestRotateCA(t *testing.T) {
+	prev := caConfig
+	defer func() { caConfig = prev }()
+
+	caConfig = &caGenerationConfig{Defaults: caSpec{KeyAlgo: "ed25519", CN: "generated"}}
+
+	current := newTestCA(t, "current", nil)
+	next := newTestCA(t, "next", nil)
+	previous := newTestCA(t, "previous", nil)
+
+	// newRotatingCA returns a CA in the given rotation phase
+	newRotatingCA := func(phase string) *CA {
+		ca := &CA{Key: current.keyPEM, Cert: current.certPEM, Signed: map[string]*KeyCert{"s1": {}}}
+
+		switch phase {
+		case caRotationGenerated, caRotationBundled:
+			ca.Rotation = &CARotation{Phase: phase, Next: &CA{Key: next.keyPEM, Cert: next.certPEM}}
+		case caRotationSwitched:
+			ca.Rotation = &CARotation{Phase: phase, Previous: &CA{Key: previous.keyPEM, Cert: previous.certPEM}}
+		}
+
+		return ca
+	}
+
+	type result struct {
+		phase, bundle string
+	}
+
+	// the results of the allowed actions; other actions are forbidden
+	allowed := map[string]map[string]result{
+		"": {
+			caRotationGenerate: {caRotationGenerated, "current"},
+		},
+		caRotationGenerated: {
+			caRotationBundle: {caRotationBundled, "current,next"},
+			caRotationCancel: {"", "current"},
+		},
+		caRotationBundled: {
+			caRotationSwitch: {caRotationSwitched, "next,current"},
+			caRotationCancel: {"", "current"},
+		},
+		caRotationSwitched: {
+			caRotationRetire: {"", "current"},
+		},
+	}
+
+	for _, phase := range []string{"", caRotationGenerated, caRotationBundled, caRotationSwitched} {
+		for _, action := range []string{caRotationGenerate, caRotationBundle, caRotationSwitch, caRotationRetire, caRotationCancel, "invalid"} {
+			phase, action := phase, action
+
+			t.Run(action+" in phase "+phase, func(t *testing.T) {
+				orig := newRotatingCA(phase)
+				origBundle := bundleCNs(t, orig)
+
+				sd := newTestSecretData()
+				sd.cluster("c1").CAs["ca1"] = orig
+
+				ca, err := sd.RotateCA("c1", "ca1", action)
+
+				expect, ok := allowed[phase][action]
+				if !ok {
+					if rerr, isRotationErr := err.(caRotationError); !isRotationErr || rerr.Action != action || rerr.Phase != phase {
+						t.Fatalf("expected a rotation error, got %v", err)
+					}
+					if ca != nil || sd.FindCA("c1", "ca1") != orig {
+						t.Error("CA changed by a forbidden action")
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if ca == orig || sd.FindCA("c1", "ca1") != ca {
+					t.Error("CA not replaced")
+				}
+
+				if p := ca.RotationPhase(); p != expect.phase {
+					t.Errorf("expected phase %q, got %q", expect.phase, p)
+				}
+
+				if b := bundleCNs(t, ca); b != expect.bundle {
+					t.Errorf("expected bundle %q, got %q", expect.bundle, b)
+				}
+
+				// the previous value is unchanged
+				if orig.RotationPhase() != phase || bundleCNs(t, orig) != origBundle || string(orig.Cert) != string(current.certPEM) {
+					t.Error("previous CA modified")
+				}
+
+				switch action {
+				case caRotationGenerate:
+					if n := ca.Rotation.Next; n == nil || !strings.Contains(string(n.Cert), "CERTIFICATE") {
+						t.Errorf("no successor CA generated: %+v", ca.Rotation)
+					}
+
+				case caRotationSwitch:
+					if string(ca.Key) != string(next.keyPEM) || len(ca.Signed) != 0 || ca.Rotation.Next != nil {
+						t.Error("successor CA not switched in")
+					}
+					if p := ca.Rotation.Previous; p == nil || string(p.Key) != string(current.keyPEM) || p.Signed["s1"] == nil {
+						t.Errorf("unexpected previous CA: %+v", p)
+					}
+				}
+
+				if ca.Rotation != nil && ca.Rotation.Updated.IsZero() {
+					t.Error("rotation update time not set")
+				}
+			})
+		}
+	}
+
+	sd := newTestSecretData()
+	for _, c := range [][2]string{{"c2", "ca1"}, {"c1", "ca2"}} {
+		if ca, err := sd.RotateCA(c[0], c[1], caRotationGenerate); ca != nil || err != nil {
+			t.Errorf("%s/%s: unexpected result: %v, %v", c[0], c[1], ca, err)
+		}
+	}
+}
+
+func TestWsClusterCARotate(t *testing.T) {
+	restore, _, _, _ := withTestCAs(t)
+	defer restore()
+
+	prevConfig, prevStore := caConfig, casStore
+	defer func() { caConfig, casStore = prevConfig, prevStore }()
+
+	caConfig = &caGenerationConfig{Defaults: caSpec{KeyAlgo: "ed25519"}}
+
+	store := &memCASStore{entries: map[string][]byte{"stale/config": nil}}
+	casStore = store
+
+	ws := (&restful.WebService{}).Produces(restful.MIME_JSON)
+	ws.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		req.SetAttribute("admin", &adminCredential{Name: "ops", Scopes: []string{scopeAll}})
+		chain.ProcessFilter(req, resp)
+	})
+	ws.Route(ws.POST("/clusters/{cluster-name}/CAs/{ca-name}/rotation/{action}").To(wsClusterCARotate))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		phase  string
+	}{
+		{"/clusters/c1/CAs/ca1/rotation/retire", http.StatusConflict, ""},
+		{"/clusters/c1/CAs/ca2/rotation/generate", http.StatusNotFound, ""},
+		{"/clusters/c1/CAs/ca1/rotation/generate", http.StatusOK, caRotationGenerated},
+		{"/clusters/c1/CAs/ca1/rotation/switch", http.StatusConflict, ""},
+		{"/clusters/c1/CAs/ca1/rotation/bundle", http.StatusOK, caRotationBundled},
+	} {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.path, nil))
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, rec.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		info := caRotationInfo{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Phase != tc.phase {
+			t.Errorf("%s: expected phase %q, got %q", tc.path, tc.phase, info.Phase)
+		}
+	}
+
+	if tags, _ := store.Tags(); len(tags) != 1 {
+		t.Errorf("cache cleaned before the switch: %v", tags)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clusters/c1/CAs/ca1/rotation/switch", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("switch: unexpected status %d", rec.Code)
+	}
+
+	// the switch cleans the cache in the background
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if tags, _ := store.Tags(); len(tags) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache not cleaned after the switch")
+		}
+	}
+
+	// wait for the cleaner to finish
+	cleanCASMutex.Lock()
+	cleanCASMutex.Unlock()
+
+	entries, _, err := auditLog.Read(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 audit entries, got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.Action != "ca-rotation-retire" || e.Cluster != "c1" || e.CA != "ca1" || !strings.HasPrefix(e.Result, "error: ") {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	if e := entries[5]; e.Action != "ca-rotation-switch" || e.CA != "ca1" || e.Result != "success" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
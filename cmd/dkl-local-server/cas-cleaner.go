@@ -4,7 +4,10 @@ import (
 	"flag"
 	"log"
 	"sort"
+	"sync"
 	"time"
+
+	"novit.nc/direktil/pkg/localconfig"
 )
 
 var (
@@ -22,7 +25,30 @@ func casCleaner() {
 	}
 }
 
+func hostTag(host *localconfig.Host, cfg *localconfig.Config) (string, error) {
+	ctx, err := newRenderContext(host, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	return ctx.Tag()
+}
+
+// cleanCASAsync removes, in the background, the CAS entries invalidated by a change (ie: of secrets).
+func cleanCASAsync() {
+	go func() {
+		if err := cleanCAS(); err != nil {
+			log.Print("warn: couldn't clean cache: ", err)
+		}
+	}()
+}
+
+var cleanCASMutex sync.Mutex
+
 func cleanCAS() error {
+	cleanCASMutex.Lock()
+	defer cleanCASMutex.Unlock()
+
 	cfg, err := readConfig()
 	if err != nil {
 		return err
@@ -31,18 +57,7 @@ func cleanCAS() error {
 	activeTags := make([]string, len(cfg.Hosts))
 
 	for i, host := range cfg.Hosts {
-		// FIXME ugly hack, same as in dir2config
-		cfg, err := readConfig()
-		if err != nil {
-			return err
-		}
-
-		ctx, err := newRenderContext(host, cfg)
-		if err != nil {
-			return err
-		}
-
-		tag, err := ctx.Tag()
+		tag, err := hostTag(host, cfg)
 		if err != nil {
 			return err
 		}
@@ -68,7 +83,10 @@ func cleanCAS() error {
 		log.Print("cache cleaner: removing tag ", tag)
 		if err := casStore.Remove(tag); err != nil {
 			log.Printf("cache cleaner: failed to remove tag %s: %v", tag, err)
+			continue
 		}
+
+		casRemovedTagsMetric.Inc()
 	}
 
 	return nil
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/cfssl/helpers"
+	"github.com/cloudflare/cfssl/log"
+)
+
+var (
+	certRenewFraction   = flag.Float64("cert-renew-fraction", 1.0/3, "Renew certificates when their remaining validity is below this fraction of their lifetime (0 disables)")
+	certRenewCheckDelay = flag.Duration("cert-renew-check-delay", time.Hour, "Time between certificate renewal checks, queueing builds for renewed hosts (0 disables)")
+
+	// certRenewals counts the renewals, to detect them between checks
+	certRenewals int64
+)
+
+// certRenewal is a certificate due for renewal.
+type certRenewal struct {
+	Cluster  string
+	CA       string
+	Name     string
+	NotAfter time.Time
+	RenewAt  time.Time
+}
+
+// loadValidity sets the validity from the certificate, for certificates stored before they were tracked.
+func (kc *KeyCert) loadValidity() error {
+	if !kc.NotAfter.IsZero() {
+		return nil
+	}
+
+	cert, err := helpers.ParseCertificatePEM(kc.Cert)
+	if err != nil {
+		return err
+	}
+
+	kc.NotBefore = cert.NotBefore
+	kc.NotAfter = cert.NotAfter
+	return nil
+}
+
+// RenewAt returns the time from which the certificate is renewed.
+func (kc *KeyCert) RenewAt() time.Time {
+	if *certRenewFraction <= 0 {
+		return kc.NotAfter
+	}
+
+	lifetime := kc.NotAfter.Sub(kc.NotBefore)
+	return kc.NotAfter.Add(-time.Duration(float64(lifetime) * *certRenewFraction))
+}
+
+func (kc *KeyCert) needsRenewal(now time.Time) bool {
+	if err := kc.loadValidity(); err != nil {
+		log.Warning("secret-data: invalid certificate, renewing it: ", err)
+		return true
+	}
+
+	return !now.Before(kc.RenewAt())
+}
+
+// Renewals returns the certificates to renew in the given duration, soonest first.
+func (sd *SecretData) Renewals(within time.Duration) (renewals []certRenewal) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	limit := time.Now().Add(within)
+
+	renewals = make([]certRenewal, 0)
+
+	for clusterName, cs := range sd.clusters {
+		for caName, ca := range cs.CAs {
+			for name, kc := range ca.Signed {
+				if err := kc.loadValidity(); err != nil {
+					log.Warningf("secret-data: cluster %s: CA %s: %s: invalid certificate: %v", clusterName, caName, name, err)
+					continue
+				}
+
+				renewAt := kc.RenewAt()
+				if renewAt.After(limit) {
+					continue
+				}
+
+				renewals = append(renewals, certRenewal{
+					Cluster:  clusterName,
+					CA:       caName,
+					Name:     name,
+					NotAfter: kc.NotAfter,
+					RenewAt:  renewAt,
+				})
+			}
+		}
+	}
+
+	sort.Slice(renewals, func(i, j int) bool { return renewals[i].RenewAt.Before(renewals[j].RenewAt) })
+	return
+}
+
+// certRenewer periodically renders every host, renewing the certificates due,
+// and queues builds for the hosts changed by renewals.
+func certRenewer() {
+	if *certRenewCheckDelay <= 0 {
+		return
+	}
+
+	var (
+		prevTags     map[string]string
+		prevRenewals = atomic.LoadInt64(&certRenewals)
+	)
+
+	for {
+		tags, err := currentTags()
+		if err != nil {
+			log.Warning("cert renewal: failed to get the current tags: ", err)
+		}
+
+		renewals := atomic.LoadInt64(&certRenewals)
+
+		if prevTags != nil && renewals != prevRenewals {
+			hostNames := make([]string, 0)
+			for host, tag := range tags {
+				if prev, ok := prevTags[host]; ok && prev != tag {
+					hostNames = append(hostNames, host)
+				}
+			}
+
+			if len(hostNames) != 0 {
+				sort.Strings(hostNames)
+				log.Infof("cert renewal: %d certificates renewed, queueing builds for %v", renewals-prevRenewals, hostNames)
+
+				if _, err := jobs.Queue(hostNames, nil); err != nil {
+					log.Warning("cert renewal: failed to queue builds: ", err)
+				}
+			}
+		}
+
+		if err == nil {
+			prevTags = tags
+		}
+		prevRenewals = renewals
+
+		time.Sleep(*certRenewCheckDelay)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCertPEM returns a self-signed certificate valid in the given period.
+func newTestCertPEM(t *testing.T, notBefore, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestKeyCertRenewAt(t *testing.T) {
+	notBefore := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * 24 * time.Hour)
+
+	for _, tc := range []struct {
+		name     string
+		fraction float64
+		expect   time.Time
+	}{
+		{"a third", 1.0 / 3, notBefore.Add(60 * 24 * time.Hour)},
+		{"half", 0.5, notBefore.Add(45 * 24 * time.Hour)},
+		{"whole lifetime", 1, notBefore},
+		{"disabled", 0, notAfter},
+		{"negative", -1, notAfter},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prev := *certRenewFraction
+			defer func() { *certRenewFraction = prev }()
+
+			*certRenewFraction = tc.fraction
+
+			kc := &KeyCert{NotBefore: notBefore, NotAfter: notAfter}
+
+			if renewAt := kc.RenewAt(); !renewAt.Equal(tc.expect) {
+				t.Errorf("expected %v, got %v", tc.expect, renewAt)
+			}
+		})
+	}
+}
+
+func TestKeyCertNeedsRenewal(t *testing.T) {
+	prev := *certRenewFraction
+	defer func() { *certRenewFraction = prev }()
+
+	*certRenewFraction = 0.5
+
+	now := time.Now().Truncate(time.Second)
+
+	for _, tc := range []struct {
+		name   string
+		kc     *KeyCert
+		expect bool
+	}{
+		{
+			name:   "fresh",
+			kc:     &KeyCert{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(10 * time.Hour)},
+			expect: false,
+		},
+		{
+			name:   "past the renewal time",
+			kc:     &KeyCert{NotBefore: now.Add(-6 * time.Hour), NotAfter: now.Add(4 * time.Hour)},
+			expect: true,
+		},
+		{
+			name:   "at the renewal time",
+			kc:     &KeyCert{NotBefore: now.Add(-5 * time.Hour), NotAfter: now.Add(5 * time.Hour)},
+			expect: true,
+		},
+		{
+			name:   "expired",
+			kc:     &KeyCert{NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(-time.Hour)},
+			expect: true,
+		},
+		{
+			name:   "validity from the certificate",
+			kc:     &KeyCert{Cert: newTestCertPEM(t, now.Add(-time.Hour), now.Add(10*time.Hour))},
+			expect: false,
+		},
+		{
+			name:   "expiring validity from the certificate",
+			kc:     &KeyCert{Cert: newTestCertPEM(t, now.Add(-10*time.Hour), now.Add(time.Hour))},
+			expect: true,
+		},
+		{
+			name:   "invalid certificate",
+			kc:     &KeyCert{Cert: []byte("not a certificate")},
+			expect: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if needed := tc.kc.needsRenewal(now); needed != tc.expect {
+				t.Errorf("expected %v, got %v", tc.expect, needed)
+			}
+		})
+	}
+}
+
+func TestRenewals(t *testing.T) {
+	prev := *certRenewFraction
+	defer func() { *certRenewFraction = prev }()
+
+	*certRenewFraction = 0.5
+
+	now := time.Now()
+
+	sd := newTestSecretData()
+	sd.clusters["c1"] = &ClusterSecrets{CAs: map[string]*CA{
+		"ca1": {Signed: map[string]*KeyCert{
+			"fresh":   {NotBefore: now.Add(-time.Hour), NotAfter: now.Add(100 * time.Hour)},
+			"soon":    {NotBefore: now.Add(-time.Hour), NotAfter: now.Add(3 * time.Hour)},
+			"due":     {NotBefore: now.Add(-10 * time.Hour), NotAfter: now.Add(time.Hour)},
+			"invalid": {Cert: []byte("not a certificate")},
+		}},
+	}}
+
+	renewals := sd.Renewals(2 * time.Hour)
+
+	if len(renewals) != 2 {
+		t.Fatalf("expected 2 renewals, got %+v", renewals)
+	}
+
+	// soonest first
+	if renewals[0].Name != "due" || renewals[1].Name != "soon" {
+		t.Errorf("unexpected renewals: %+v", renewals)
+	}
+}
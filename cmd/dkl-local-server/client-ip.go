@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+var (
+	trustedProxiesFlag = flag.String("trusted-proxies", "", "Comma-separated CIDRs of the proxies trusted to set the forwarding header")
+	forwardedHeader    = flag.String("forwarded-header", "xff", "Forwarding header set by the trusted proxies: xff (X-Forwarded-For) or forwarded (RFC 7239 Forwarded)")
+
+	// replaced by -trusted-proxies, kept so existing command lines fail with a clear message
+	_ = flag.Bool("trust-xff", false, "Deprecated: use -trusted-proxies")
+
+	trustedProxies []*net.IPNet
+)
+
+func setupTrustedProxies() (err error) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "trust-xff" {
+			err = errors.New("-trust-xff is not supported anymore: list the proxies with -trusted-proxies (and set -forwarded-header)")
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	switch *forwardedHeader {
+	case "xff", "forwarded":
+	default:
+		return fmt.Errorf("invalid forwarded header: %q (expected xff or forwarded)", *forwardedHeader)
+	}
+
+	trustedProxies = make([]*net.IPNet, 0)
+
+	for _, s := range strings.Split(*trustedProxiesFlag, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			// single IP
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+		}
+
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	return
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the client's IP, walking the forwarding header right to left
+// as long as the hops are trusted proxies. Only the header selected by
+// -forwarded-header is read: the other one may come from the client untouched.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(peer)
+	if ip == nil || !isTrustedProxy(ip) {
+		return peer
+	}
+
+	var hops []string
+	if *forwardedHeader == "forwarded" {
+		hops = forwardedFor(r.Header)
+	} else {
+		hops = xForwardedFor(r.Header)
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hopIP := parseHop(hops[i])
+		if hopIP == nil {
+			// unusable value (obfuscated, "unknown" or invalid): stop at the last known hop
+			break
+		}
+
+		client = hopIP.String()
+
+		if !isTrustedProxy(hopIP) {
+			break
+		}
+	}
+
+	return client
+}
+
+func xForwardedFor(header http.Header) (hops []string) {
+	for _, value := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return
+}
+
+// forwardedFor returns the "for" parameters of the Forwarded header (RFC 7239).
+func forwardedFor(header http.Header) (hops []string) {
+	for _, value := range header["Forwarded"] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 || !strings.EqualFold(pair[:eq], "for") {
+					continue
+				}
+
+				hops = append(hops, strings.Trim(pair[eq+1:], `"`))
+			}
+		}
+	}
+	return
+}
+
+// parseHop parses an IP, with an optional port and brackets for IPv6 ("[::1]:80").
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+func logClientFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	r := req.Request
+	log.Printf("%s %s from %s (peer %s)", r.Method, r.URL.Path, clientIP(r), r.RemoteAddr)
+
+	chain.ProcessFilter(req, resp)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// withTrustedProxies sets up the trusted proxies, returning a function restoring the previous setup.
+func withTrustedProxies(t *testing.T, proxies, header string) (restore func()) {
+	prevProxies, prevHeader := *trustedProxiesFlag, *forwardedHeader
+	restore = func() {
+		*trustedProxiesFlag, *forwardedHeader = prevProxies, prevHeader
+		setupTrustedProxies()
+	}
+
+	*trustedProxiesFlag, *forwardedHeader = proxies, header
+	if err := setupTrustedProxies(); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		header  string
+		peer    string
+		headers map[string]string
+		expect  string
+	}{
+		{
+			name:   "untrusted peer",
+			header: "xff",
+			peer:   "192.0.2.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			expect: "192.0.2.1",
+		},
+		{
+			name:   "trusted peer without header",
+			header: "xff",
+			peer:   "10.0.0.1:1234",
+			expect: "10.0.0.1",
+		},
+		{
+			name:   "xff",
+			header: "xff",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			expect: "198.51.100.1",
+		},
+		{
+			name:   "xff stops at the first untrusted hop",
+			header: "xff",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "203.0.113.66, 198.51.100.1, 10.0.0.2",
+			},
+			expect: "198.51.100.1",
+		},
+		{
+			name:   "xff only trusted hops",
+			header: "xff",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "10.0.0.3, 10.0.0.2",
+			},
+			expect: "10.0.0.3",
+		},
+		{
+			name:   "xff unusable hop",
+			header: "xff",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "198.51.100.1, unknown",
+			},
+			expect: "10.0.0.1",
+		},
+		{
+			name:   "spoofed Forwarded ignored behind an xff proxy",
+			header: "xff",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded":       "for=203.0.113.66",
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			expect: "198.51.100.1",
+		},
+		{
+			name:   "forwarded",
+			header: "forwarded",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded": `for=198.51.100.1;proto=https, for="10.0.0.2:8080"`,
+			},
+			expect: "198.51.100.1",
+		},
+		{
+			name:   "forwarded ipv6",
+			header: "forwarded",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded": `For="[2001:db8::1]:4711"`,
+			},
+			expect: "2001:db8::1",
+		},
+		{
+			name:   "spoofed xff ignored behind a forwarded proxy",
+			header: "forwarded",
+			peer:   "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded":       "for=198.51.100.1",
+				"X-Forwarded-For": "203.0.113.66",
+			},
+			expect: "198.51.100.1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer withTrustedProxies(t, "10.0.0.0/24", tc.header)()
+
+			r := &http.Request{RemoteAddr: tc.peer, Header: http.Header{}}
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+
+			if ip := clientIP(r); ip != tc.expect {
+				t.Errorf("expected %s, got %s", tc.expect, ip)
+			}
+		})
+	}
+}
+
+func TestSetupTrustedProxies(t *testing.T) {
+	defer withTrustedProxies(t, "10.0.0.1, 2001:db8::/32", "xff")()
+
+	if len(trustedProxies) != 2 {
+		t.Fatalf("expected 2 trusted proxies, got %v", trustedProxies)
+	}
+	if s := trustedProxies[0].String(); s != "10.0.0.1/32" {
+		t.Errorf("single IP parsed as %s", s)
+	}
+
+	*forwardedHeader = "x-real-ip"
+	if err := setupTrustedProxies(); err == nil {
+		t.Error("invalid forwarded header accepted")
+	}
+}
+
+func TestParseHop(t *testing.T) {
+	for hop, expect := range map[string]string{
+		"192.0.2.1":         "192.0.2.1",
+		"192.0.2.1:80":      "192.0.2.1",
+		"[2001:db8::1]":     "2001:db8::1",
+		"[2001:db8::1]:443": "2001:db8::1",
+		"2001:db8::1":       "2001:db8::1",
+		"unknown":           "<nil>",
+		"_hidden":           "<nil>",
+	} {
+		if ip := parseHop(hop).String(); ip != expect {
+			t.Errorf("%q: expected %s, got %s", hop, expect, ip)
+		}
+	}
+}
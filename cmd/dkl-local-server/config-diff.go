@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+
+	"novit.nc/direktil/pkg/config"
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+// hostDiff describes how a host changes between two configs.
+type hostDiff struct {
+	Host     string
+	Status   string                 // added, removed or changed
+	Kernel   *valueChange           `json:",omitempty"`
+	Initrd   *valueChange           `json:",omitempty"`
+	Versions map[string]valueChange `json:",omitempty"`
+	Config   string                 `json:",omitempty"`
+	Error    string                 `json:",omitempty"`
+}
+
+type valueChange struct {
+	From string
+	To   string
+}
+
+// readConfigFrom parses a config from a reader, without activating it.
+func readConfigFrom(reader io.Reader) (cfg *localconfig.Config, err error) {
+	f, err := ioutil.TempFile(*dataDir, ".config-diff")
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, reader)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	return localconfig.FromFile(f.Name())
+}
+
+// diffConfigs returns the hosts changing between the two configs.
+func diffConfigs(from, to *localconfig.Config) (diffs []hostDiff) {
+	diffs = make([]hostDiff, 0)
+
+	names := map[string]bool{}
+	for _, cfg := range []*localconfig.Config{from, to} {
+		for _, host := range cfg.Hosts {
+			names[host.Name] = true
+		}
+	}
+
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	for _, name := range sortedNames {
+		diff := diffHost(name, from.Host(name), to.Host(name))
+
+		if diff.Status == "changed" && diff.Kernel == nil && diff.Initrd == nil &&
+			len(diff.Versions) == 0 && diff.Config == "" && diff.Error == "" {
+			continue
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	return
+}
+
+func diffHost(name string, from, to *localconfig.Host) (diff hostDiff) {
+	diff = hostDiff{Host: name, Status: "changed"}
+
+	switch {
+	case from == nil:
+		diff.Status = "added"
+		from = &localconfig.Host{}
+	case to == nil:
+		diff.Status = "removed"
+		to = &localconfig.Host{}
+	}
+
+	if from.Kernel != to.Kernel {
+		diff.Kernel = &valueChange{from.Kernel, to.Kernel}
+	}
+	if from.Initrd != to.Initrd {
+		diff.Initrd = &valueChange{from.Initrd, to.Initrd}
+	}
+
+	for _, versions := range []map[string]string{from.Versions, to.Versions} {
+		for layer := range versions {
+			if from.Versions[layer] == to.Versions[layer] {
+				continue
+			}
+
+			if diff.Versions == nil {
+				diff.Versions = map[string]valueChange{}
+			}
+			diff.Versions[layer] = valueChange{from.Versions[layer], to.Versions[layer]}
+		}
+	}
+
+	var fromCfg, toCfg string
+
+	for _, r := range []struct {
+		host *localconfig.Host
+		out  *string
+	}{{from, &fromCfg}, {to, &toCfg}} {
+		if r.host.Config == "" {
+			continue
+		}
+
+		ctx := &renderContext{Host: r.host}
+
+		funcs, err := ctx.redactedTemplateFuncs()
+		if err != nil {
+			diff.Error = err.Error()
+			return
+		}
+
+		ba, err := ctx.renderConfigTemplate(funcs)
+		if err != nil {
+			diff.Error = fmt.Sprintf("failed to render config: %v", err)
+			return
+		}
+
+		*r.out = string(ba)
+	}
+
+	diff.Config = unifiedDiff("a/"+name+"/config", "b/"+name+"/config", fromCfg, toCfg)
+	return
+}
+
+// diffSafeTemplateFuncs are the template functions called as is by diffs: they
+// emit no secret and have no side effect. The other ones are redacted.
+var diffSafeTemplateFuncs = map[string]bool{}
+
+// redactedTemplateFuncs are the template functions with every secret (and
+// generated) value replaced by a placeholder. They have no side effect, so new
+// secrets or certificates aren't created by a diff.
+func (ctx *renderContext) redactedTemplateFuncs() (funcs map[string]interface{}, err error) {
+	redacted := func(kind string, args ...string) string {
+		return "<redacted " + kind + " " + strings.Join(args, "/") + ">"
+	}
+
+	dir := func(dir string, files map[string]string) (string, error) {
+		defs := make([]config.FileDef, 0, len(files))
+
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			mode := os.FileMode(0644)
+			if strings.HasSuffix(name, ".key") {
+				mode = 0600
+			}
+
+			defs = append(defs, config.FileDef{
+				Path:    path.Join(dir, name),
+				Mode:    mode,
+				Content: files[name],
+			})
+		}
+
+		return asYaml(defs)
+	}
+
+	redactedFuncs := map[string]interface{}{
+		"host_token": func() string {
+			return redacted("host_token", ctx.Host.Name)
+		},
+		"host_crt": func() string {
+			return redacted("host_crt", ctx.Host.Name)
+		},
+		"host_key": func() string {
+			return redacted("host_key", ctx.Host.Name)
+		},
+		"password": func(cluster, name string) string {
+			return redacted("password", cluster, name)
+		},
+		"token": func(cluster, name string) string {
+			return redacted("token", cluster, name)
+		},
+		"ca_key": func(cluster, name string) string {
+			return redacted("ca_key", cluster, name)
+		},
+		"ca_crt": func(cluster, name string) string {
+			return redacted("ca_crt", cluster, name)
+		},
+		"ca_chain": func(cluster, name string) string {
+			return redacted("ca_chain", cluster, name)
+		},
+		"ca_dir": func(cluster, name string) (string, error) {
+			return dir("/etc/tls-ca/"+name, map[string]string{
+				"ca.crt": redacted("ca_crt", cluster, name),
+				"ca.key": redacted("ca_key", cluster, name),
+			})
+		},
+		"tls_key": func(cluster, caName, name, profile, label, reqJson string) string {
+			return redacted("tls_key", cluster, caName, name)
+		},
+		"tls_crt": func(cluster, caName, name, profile, label, reqJson string) string {
+			return redacted("tls_crt", cluster, caName, name, profile, label, reqJson)
+		},
+		"tls_crt_chain": func(cluster, caName, name, profile, label, reqJson string) string {
+			return redacted("tls_crt_chain", cluster, caName, name, profile, label, reqJson)
+		},
+		"tls_dir": func(dirPath, cluster, caName, name, profile, label, reqJson string) (string, error) {
+			return dir(dirPath, map[string]string{
+				"ca.crt":  redacted("ca_crt", cluster, caName),
+				"tls.crt": redacted("tls_crt", cluster, caName, name, profile, label, reqJson),
+				"tls.key": redacted("tls_key", cluster, caName, name),
+			})
+		},
+	}
+
+	funcs = make(map[string]interface{})
+
+	for name, f := range ctx.templateFuncs() {
+		name := name
+
+		switch {
+		case diffSafeTemplateFuncs[name]:
+			funcs[name] = f
+
+		case redactedFuncs[name] != nil:
+			funcs[name] = redactedFuncs[name]
+
+		default:
+			// no specific placeholder: redact the whole value
+			funcs[name], err = redactedFunc(f, func(args []string) string {
+				return redacted(name, args...)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("template function %s: %v", name, err)
+			}
+		}
+	}
+
+	return
+}
+
+// redactedFunc returns a function with f's signature, returning the placeholder instead of calling f.
+// The function must return a string, optionally followed by an error.
+func redactedFunc(f interface{}, placeholder func(args []string) string) (interface{}, error) {
+	fType := reflect.TypeOf(f)
+
+	if fType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("not a function: %s", fType)
+	}
+
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+
+	switch {
+	case fType.NumOut() == 1 && fType.Out(0).Kind() == reflect.String:
+	case fType.NumOut() == 2 && fType.Out(0).Kind() == reflect.String && fType.Out(1) == errorType:
+	default:
+		return nil, fmt.Errorf("can't redact a function of type %s", fType)
+	}
+
+	return reflect.MakeFunc(fType, func(in []reflect.Value) []reflect.Value {
+		args := make([]string, len(in))
+		for i, v := range in {
+			args[i] = fmt.Sprint(v.Interface())
+		}
+
+		out := []reflect.Value{reflect.ValueOf(placeholder(args)).Convert(fType.Out(0))}
+		if fType.NumOut() == 2 {
+			out = append(out, reflect.Zero(errorType))
+		}
+		return out
+	}).Interface(), nil
+}
+
+// unifiedDiff returns the unified diff (with 3 lines of context) between a and b.
+func unifiedDiff(fromName, toName, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	const context = 3
+
+	type line struct {
+		op   byte
+		text string
+	}
+
+	dmp := diffmatchpatch.New()
+	ca, cb, lineArray := dmp.DiffLinesToChars(a, b)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(ca, cb, false), lineArray)
+
+	lines := make([]line, 0)
+	for _, d := range diffs {
+		op := byte(' ')
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			op = '-'
+		case diffmatchpatch.DiffInsert:
+			op = '+'
+		}
+
+		for _, text := range strings.SplitAfter(d.Text, "\n") {
+			if text == "" {
+				continue
+			}
+			lines = append(lines, line{op, text})
+		}
+	}
+
+	// line numbers before each line
+	aPos := make([]int, len(lines)+1)
+	bPos := make([]int, len(lines)+1)
+	for i, l := range lines {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if l.op != '+' {
+			aPos[i+1]++
+		}
+		if l.op != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", fromName, toName)
+
+	for i := 0; i < len(lines); {
+		for i < len(lines) && lines[i].op == ' ' {
+			i++
+		}
+		if i == len(lines) {
+			break
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// extend the hunk while changes are close enough
+		end := i + 1
+		for j := i + 1; j < len(lines); j++ {
+			if lines[j].op != ' ' {
+				end = j + 1
+			} else if j-end+1 > 2*context {
+				break
+			}
+		}
+
+		stop := end + context
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		aStart, aCount := aPos[start]+1, aPos[stop]-aPos[start]
+		bStart, bCount := bPos[start]+1, bPos[stop]-bPos[start]
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+
+		fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+
+		for _, l := range lines[start:stop] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = stop
+	}
+
+	return out.String()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		a, b   string
+		expect string
+	}{
+		{
+			name: "same",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+		},
+		{
+			name:   "added",
+			a:      "",
+			b:      "a\nb\n",
+			expect: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:   "removed",
+			a:      "a\nb\n",
+			b:      "",
+			expect: "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name:   "context",
+			a:      "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:      "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			expect: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "two hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			expect: "--- a\n+++ b\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+		{
+			name:   "close changes share a hunk",
+			a:      "1\n2\n3\n4\n5\n6\n",
+			b:      "one\n2\n3\n4\n5\nsix\n",
+			expect: "--- a\n+++ b\n@@ -1,6 +1,6 @@\n-1\n+one\n 2\n 3\n 4\n 5\n-6\n+six\n",
+		},
+		{
+			name:   "no newline at end of file",
+			a:      "a\nb",
+			b:      "a\nc",
+			expect: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := unifiedDiff("a", "b", tc.a, tc.b); diff != tc.expect {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expect, diff)
+			}
+		})
+	}
+}
+
+func TestRedactedTemplateFuncs(t *testing.T) {
+	// the redacted functions must not touch the secret data
+	prev := secretData
+	secretData = nil
+	defer func() { secretData = prev }()
+
+	ctx := &renderContext{Host: &localconfig.Host{
+		Name: "host1",
+		Config: `token: {{ token "c1" "t1" }}
+host_token: {{ host_token }}
+password: {{ password "c1" "p1" }}
+ca_key: {{ ca_key "c1" "ca1" }}
+ca_crt: {{ ca_crt "c1" "ca1" }}
+tls_key: {{ tls_key "c1" "ca1" "n1" "server" "" "{}" }}
+tls_crt: {{ tls_crt "c1" "ca1" "n1" "server" "" "{}" }}
+files:
+{{ tls_dir "/etc/tls/n1" "c1" "ca1" "n1" "server" "" "{}" }}`,
+	}}
+
+	funcs, err := ctx.redactedTemplateFuncs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range ctx.templateFuncs() {
+		if funcs[name] == nil {
+			t.Errorf("function %s missing", name)
+		}
+	}
+
+	ba, err := ctx.renderConfigTemplate(funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"token: <redacted token c1/t1>",
+		"host_token: <redacted host_token host1>",
+		"password: <redacted password c1/p1>",
+		"ca_key: <redacted ca_key c1/ca1>",
+		"tls_key: <redacted tls_key c1/ca1/n1>",
+		"content: <redacted tls_key c1/ca1/n1>",
+		"path: /etc/tls/n1/tls.key",
+	} {
+		if !strings.Contains(string(ba), expected) {
+			t.Errorf("%q not found in:\n%s", expected, ba)
+		}
+	}
+}
+
+func TestRedactedFunc(t *testing.T) {
+	placeholder := func(args []string) string {
+		return "<" + strings.Join(args, "/") + ">"
+	}
+
+	// a secret-emitting function without a specific placeholder
+	f, err := redactedFunc(func(cluster, name string) (string, error) {
+		t.Error("redacted function called")
+		return "secret", nil
+	}, placeholder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := f.(func(string, string) (string, error))("c1", "n1")
+	if err != nil || s != "<c1/n1>" {
+		t.Errorf("unexpected result: %q, %v", s, err)
+	}
+
+	g, err := redactedFunc(func(n int) string { return "secret" }, placeholder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := g.(func(int) string)(42); s != "<42>" {
+		t.Errorf("unexpected result: %q", s)
+	}
+
+	for _, invalid := range []interface{}{
+		"not a function",
+		func() []byte { return nil },
+		func() (string, int) { return "", 0 },
+	} {
+		if _, err := redactedFunc(invalid, placeholder); err == nil {
+			t.Errorf("%T accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	configSignersFile = flag.String("config-signers", "", "YAML file of the ed25519 public keys allowed to sign configs (signatures are required when set)")
+
+	configSigners []*configSigner
+
+	errConfigNotSigned    = errors.New("config signature required")
+	errConfigBadSignature = errors.New("config signature is invalid or from an unknown signer")
+)
+
+// configSigner is a signer allowed to upload configs.
+type configSigner struct {
+	Name string
+	// Key is the PEM encoded public key (ie: openssl pkey -pubout)
+	Key string
+
+	publicKey ed25519.PublicKey
+}
+
+func loadConfigSigners() (err error) {
+	if *configSignersFile == "" {
+		return
+	}
+
+	ba, err := ioutil.ReadFile(*configSignersFile)
+	if err != nil {
+		return
+	}
+
+	signers := make([]*configSigner, 0)
+	if err = yaml.UnmarshalStrict(ba, &signers); err != nil {
+		return fmt.Errorf("%s: %v", *configSignersFile, err)
+	}
+
+	for i, signer := range signers {
+		if signer.Name == "" {
+			return fmt.Errorf("%s: signer %d: name is required", *configSignersFile, i)
+		}
+
+		signer.publicKey, err = parseSignerKey(signer.Key)
+		if err != nil {
+			return fmt.Errorf("%s: signer %q: %v", *configSignersFile, signer.Name, err)
+		}
+	}
+
+	log.Printf("loaded %d config signers", len(signers))
+
+	configSigners = signers
+	return
+}
+
+func parseSignerKey(key string) (pub ed25519.PublicKey, err error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return
+	}
+
+	pub, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 key (%T)", k)
+	}
+
+	return
+}
+
+func configSignaturesRequired() bool {
+	return *configSignersFile != ""
+}
+
+// verifyConfigSignature returns the name of the config's signer.
+func verifyConfigSignature(content, signature []byte) (signer string, err error) {
+	if len(signature) == 0 {
+		return "", errConfigNotSigned
+	}
+
+	for _, s := range configSigners {
+		if ed25519.Verify(s.publicKey, content, signature) {
+			return s.Name, nil
+		}
+	}
+
+	return "", errConfigBadSignature
+}
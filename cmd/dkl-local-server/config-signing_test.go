@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestSigner(t *testing.T) (pubPEM string, priv ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), priv
+}
+
+// withConfigSigners loads the signers from YAML, returning a function restoring the previous ones.
+func withConfigSigners(t *testing.T, signersYAML string) (restore func(), err error) {
+	f, err := ioutil.TempFile("", "config-signers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString(signersYAML)
+	f.Close()
+
+	prevFile, prevSigners := *configSignersFile, configSigners
+	restore = func() {
+		*configSignersFile, configSigners = prevFile, prevSigners
+		os.Remove(f.Name())
+	}
+
+	*configSignersFile = f.Name()
+	err = loadConfigSigners()
+	return
+}
+
+func indent(s string) (out string) {
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		out += "    " + line + "\n"
+	}
+	return
+}
+
+func TestVerifyConfigSignature(t *testing.T) {
+	alicePub, alice := newTestSigner(t)
+	bobPub, bob := newTestSigner(t)
+	_, mallory := newTestSigner(t)
+
+	restore, err := withConfigSigners(t, "- name: alice\n  key: |\n"+indent(alicePub)+
+		"- name: bob\n  key: |\n"+indent(bobPub))
+	defer restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !configSignaturesRequired() {
+		t.Error("signatures not required with signers")
+	}
+
+	content := []byte("hosts: []\n")
+
+	for _, tc := range []struct {
+		name      string
+		content   []byte
+		signature []byte
+		signer    string
+		err       error
+	}{
+		{"alice", content, ed25519.Sign(alice, content), "alice", nil},
+		{"bob", content, ed25519.Sign(bob, content), "bob", nil},
+		{"unsigned", content, nil, "", errConfigNotSigned},
+		{"unknown signer", content, ed25519.Sign(mallory, content), "", errConfigBadSignature},
+		{"altered content", []byte("hosts: [x]\n"), ed25519.Sign(alice, content), "", errConfigBadSignature},
+		{"garbage signature", content, []byte("not a signature"), "", errConfigBadSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			signer, err := verifyConfigSignature(tc.content, tc.signature)
+			if err != tc.err {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+			if signer != tc.signer {
+				t.Errorf("expected signer %q, got %q", tc.signer, signer)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSignersErrors(t *testing.T) {
+	pub, _ := newTestSigner(t)
+
+	for name, signersYAML := range map[string]string{
+		"no name":       "- key: |\n" + indent(pub),
+		"no key":        "- name: alice\n",
+		"not PEM":       "- name: alice\n  key: abc\n",
+		"unknown field": "- name: alice\n  pubkey: abc\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			restore, err := withConfigSigners(t, signersYAML)
+			defer restore()
+
+			if err == nil {
+				t.Error("invalid signers accepted")
+			}
+		})
+	}
+}
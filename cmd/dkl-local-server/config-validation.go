@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	cfsslconfig "github.com/cloudflare/cfssl/config"
+	yaml "gopkg.in/yaml.v2"
+
+	"novit.nc/direktil/pkg/config"
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+// configError is a validation error of an uploaded config, for a host or the whole config.
+type configError struct {
+	Host  string `json:",omitempty"`
+	Error string
+}
+
+// configValidationError rejects an uploaded config.
+type configValidationError struct {
+	Errors []configError
+}
+
+func (e *configValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %d errors", len(e.Errors))
+}
+
+// validateConfigFile parses the config and does a dry-run render of every host.
+func validateConfigFile(path string) (cfg *localconfig.Config, err error) {
+	cfg, err = localconfig.FromFile(path)
+	if err != nil {
+		err = &configValidationError{[]configError{{Error: "failed to parse: " + err.Error()}}}
+		return
+	}
+
+	if errs := validateConfig(cfg); len(errs) != 0 {
+		return nil, &configValidationError{errs}
+	}
+
+	return
+}
+
+func validateConfig(cfg *localconfig.Config) (errs []configError) {
+	errs = make([]configError, 0)
+
+	sslCfg := &cfsslconfig.Config{}
+	if len(cfg.SSLConfig) != 0 {
+		var err error
+		sslCfg, err = cfsslconfig.LoadConfig([]byte(cfg.SSLConfig))
+		if err != nil {
+			errs = append(errs, configError{Error: "invalid SSL config: " + err.Error()})
+			return
+		}
+	}
+
+	// the hosts are rendered with a copy of the secret data, signing with the
+	// candidate's policy, so the validation doesn't create or change anything
+	sd, err := dryRunSecretData(sslCfg)
+	if err != nil {
+		errs = append(errs, configError{Error: "failed to load secret data: " + err.Error()})
+		return
+	}
+
+	seen := map[string]bool{}
+
+	for _, host := range cfg.Hosts {
+		if seen[host.Name] {
+			errs = append(errs, configError{host.Name, "duplicate host"})
+			continue
+		}
+		seen[host.Name] = true
+
+		for _, err := range validateHost(host, cfg, sd) {
+			errs = append(errs, configError{host.Name, err.Error()})
+		}
+	}
+
+	return
+}
+
+func validateHost(host *localconfig.Host, cfg *localconfig.Config, sd *SecretData) (errs []error) {
+	ctx := &renderContext{
+		Host:      host,
+		SSLConfig: cfg.SSLConfig,
+		secrets:   sd,
+	}
+
+	ba, err := ctx.renderConfigTemplate(ctx.templateFuncs())
+	if err != nil {
+		return []error{fmt.Errorf("failed to render config: %v", err)}
+	}
+
+	hostCfg := &config.Config{}
+	if err = yaml.Unmarshal(ba, hostCfg); err != nil {
+		return []error{fmt.Errorf("rendered config is invalid: %v", err)}
+	}
+
+	for _, layer := range hostCfg.Layers {
+		if host.Versions[layer] == "" {
+			errs = append(errs, fmt.Errorf("layer %q not mapped to a version", layer))
+		}
+	}
+
+	return
+}
@@ -1,20 +1,219 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	yaml "gopkg.in/yaml.v2"
 	"novit.nc/direktil/pkg/localconfig"
 )
 
 var (
-	dataDir = flag.String("data", "/var/lib/direktil", "Data dir")
+	dataDir          = flag.String("data", "/var/lib/direktil", "Data dir")
+	configWatchDelay = flag.Duration("config-watch-delay", 5*time.Second, "Time between config file change checks")
+
+	currentConfig atomic.Value // *configSnapshot
+	configMutex   sync.Mutex
 )
 
+type configSnapshot struct {
+	config   *localconfig.Config
+	hostMeta map[string]hostMeta // nil if the config has no host metadata
+	modTime  time.Time
+	size     int64
+}
+
+// hostMeta is the host's placement, written by dkl-dir2config next to the localconfig fields.
+type hostMeta struct {
+	Cluster string
+	Group   string
+}
+
+// errNoHostMeta is returned when the host placement is needed but the config
+// doesn't have it (produced by a dkl-dir2config older than the host_meta key).
+var errNoHostMeta = errors.New("config has no host metadata (host_meta), regenerate it with an up-to-date dkl-dir2config")
+
+// dataDirLock is held by the process using the data dir; offline operations
+// (ie: re-keying) take it too, so they can't run along a server.
+var dataDirLock *os.File
+
+var errDataDirLocked = errors.New("the data dir is in use (is the server running?)")
+
+func lockDataDir() (err error) {
+	if err = os.MkdirAll(*dataDir, 0755); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(*dataDir, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			err = errDataDirLocked
+		}
+		return
+	}
+
+	// the lock is released when the file is closed
+	dataDirLock = f
+	return
+}
+
+// lockConfigFiles locks the config, its meta and its archives against other
+// processes: writes take it exclusive, backups (made by another process than
+// the server's) take it shared.
+func lockConfigFiles(exclusive bool) (unlock func(), err error) {
+	if err = os.MkdirAll(*dataDir, 0755); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(*dataDir, ".config.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err = syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return
+	}
+
+	// the lock is released when the file is closed
+	return func() { f.Close() }, nil
+}
+
 func configFilePath() string {
 	return filepath.Join(*dataDir, "config.yaml")
 }
 
+// readConfig returns the current configuration, loading it on first use.
+// The returned value is shared by every caller and must not be modified.
 func readConfig() (config *localconfig.Config, err error) {
-	return localconfig.FromFile(configFilePath())
+	if snapshot, ok := currentConfig.Load().(*configSnapshot); ok {
+		return snapshot.config, nil
+	}
+
+	if err = reloadConfig(); err != nil {
+		return
+	}
+
+	return currentConfig.Load().(*configSnapshot).config, nil
+}
+
+// reloadConfig parses the config file and atomically replaces the current configuration.
+func reloadConfig() (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	stat, err := os.Stat(configFilePath())
+	if err != nil {
+		return
+	}
+
+	config, err := localconfig.FromFile(configFilePath())
+	if err != nil {
+		return
+	}
+
+	meta, err := readHostsMeta(configFilePath())
+	if err != nil {
+		return
+	}
+
+	if meta == nil {
+		log.Print("warn: ", errNoHostMeta)
+	}
+
+	currentConfig.Store(&configSnapshot{
+		config:   config,
+		hostMeta: meta,
+		modTime:  stat.ModTime(),
+		size:     stat.Size(),
+	})
+
+	log.Printf("config loaded (%d clusters, %d hosts)", len(config.Clusters), len(config.Hosts))
+	return
+}
+
+// readHostsMeta reads the host_meta key of the config file (ignored by localconfig).
+// The returned map is nil if the key is absent.
+func readHostsMeta(path string) (meta map[string]hostMeta, err error) {
+	ba, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	v := struct {
+		HostMeta map[string]hostMeta `yaml:"host_meta"`
+	}{}
+
+	if err = yaml.Unmarshal(ba, &v); err != nil {
+		return
+	}
+
+	meta = v.HostMeta
+	return
+}
+
+// readHostMeta returns the current placement of the given host.
+// It fails with errNoHostMeta if the config has no host metadata.
+func readHostMeta(hostName string) (meta hostMeta, err error) {
+	if _, err = readConfig(); err != nil {
+		return
+	}
+
+	snapshot := currentConfig.Load().(*configSnapshot)
+	if snapshot.hostMeta == nil {
+		err = errNoHostMeta
+		return
+	}
+
+	return snapshot.hostMeta[hostName], nil
+}
+
+func configWatcher() {
+	for {
+		time.Sleep(*configWatchDelay)
+
+		if err := reloadConfigIfChanged(); err != nil {
+			log.Print("warn: ", err)
+		}
+	}
+}
+
+// reloadConfigIfChanged reloads the config if the file changed since it was loaded.
+// On error, the current configuration is kept.
+func reloadConfigIfChanged() (err error) {
+	stat, err := os.Stat(configFilePath())
+	if err != nil {
+		return fmt.Errorf("couldn't check config file: %v", err)
+	}
+
+	if snapshot, ok := currentConfig.Load().(*configSnapshot); ok &&
+		stat.ModTime().Equal(snapshot.modTime) && stat.Size() == snapshot.size {
+		return
+	}
+
+	log.Print("config file changed, reloading")
+	if err = reloadConfig(); err != nil {
+		return fmt.Errorf("couldn't reload config: %v", err)
+	}
+	return
 }
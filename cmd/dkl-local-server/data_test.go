@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withConfig uses a temporary data dir without loaded config, returning a function restoring the previous state.
+func withConfig(t *testing.T) (restore func()) {
+	restoreDataDir := withDataDir(t)
+
+	prev := currentConfig
+	currentConfig = atomic.Value{}
+
+	return func() {
+		currentConfig = prev
+		restoreDataDir()
+	}
+}
+
+// writeTestConfig writes the config file, with a distinct modification time on each call.
+func writeTestConfig(t *testing.T, config string) {
+	if err := ioutil.WriteFile(configFilePath(), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Now().Add(time.Duration(len(config)) * time.Second)
+	if err := os.Chtimes(configFilePath(), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	defer withConfig(t)()
+
+	if _, err := readConfig(); err == nil {
+		t.Fatal("no error without config file")
+	}
+
+	writeTestConfig(t, "hosts: [{name: h1}]\n")
+
+	config, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Hosts) != 1 {
+		t.Fatalf("unexpected hosts: %v", config.Hosts)
+	}
+
+	// loaded once, then shared until reloaded
+	writeTestConfig(t, "hosts: [{name: h1}, {name: h2}]\n")
+
+	if again, _ := readConfig(); again != config {
+		t.Error("config loaded again without reload")
+	}
+
+	if err = reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, _ := readConfig()
+	if reloaded == config || len(reloaded.Hosts) != 2 {
+		t.Errorf("config not reloaded: %v", reloaded.Hosts)
+	}
+	if again, _ := readConfig(); again != reloaded {
+		t.Error("config changed without reload")
+	}
+}
+
+func TestReloadConfigKeepsPrevious(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+	}{
+		{"invalid config", "hosts: {{"},
+		{"invalid host metadata", "hosts: [{name: h1}]\nhost_meta: [not a map]\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer withConfig(t)()
+
+			writeTestConfig(t, "hosts: [{name: h1}]\nhost_meta: {h1: {cluster: c1}}\n")
+
+			config, err := readConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeTestConfig(t, tc.config)
+
+			if err = reloadConfig(); err == nil {
+				t.Fatal("no error")
+			}
+
+			if again, err := readConfig(); err != nil || again != config {
+				t.Errorf("previous config not kept: %v, %v", again, err)
+			}
+
+			if meta, err := readHostMeta("h1"); err != nil || meta.Cluster != "c1" {
+				t.Errorf("previous host metadata not kept: %+v, %v", meta, err)
+			}
+		})
+	}
+}
+
+func TestReloadConfigIfChanged(t *testing.T) {
+	defer withConfig(t)()
+
+	writeTestConfig(t, "hosts: [{name: h1}]\n")
+
+	if err := reloadConfigIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, _ := readConfig()
+
+	// unchanged
+	if err := reloadConfigIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := readConfig(); again != config {
+		t.Error("config reloaded while unchanged")
+	}
+
+	// rejected: the previous config is kept, and the error reported on each check
+	writeTestConfig(t, "hosts: {{")
+
+	for i := 0; i < 2; i++ {
+		if err := reloadConfigIfChanged(); err == nil {
+			t.Error("no error")
+		}
+		if again, _ := readConfig(); again != config {
+			t.Error("previous config not kept")
+		}
+	}
+
+	// fixed
+	writeTestConfig(t, "hosts: [{name: h1}, {name: h2}]\n")
+
+	if err := reloadConfigIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, _ := readConfig(); reloaded == config || len(reloaded.Hosts) != 2 {
+		t.Error("config not reloaded")
+	}
+
+	// removed
+	os.Remove(configFilePath())
+
+	if err := reloadConfigIfChanged(); err == nil {
+		t.Error("no error without config file")
+	}
+	if c, err := readConfig(); err != nil || len(c.Hosts) != 2 {
+		t.Error("config not kept after the file removal")
+	}
+}
+
+func TestReadHostMeta(t *testing.T) {
+	defer withConfig(t)()
+
+	// produced by a dkl-dir2config older than host_meta
+	writeTestConfig(t, "hosts: [{name: h1}]\n")
+
+	if _, err := readHostMeta("h1"); err != errNoHostMeta {
+		t.Errorf("expected errNoHostMeta, got %v", err)
+	}
+
+	writeTestConfig(t, "hosts: [{name: h1}]\nhost_meta: {h1: {cluster: c1, group: g1}}\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if meta, err := readHostMeta("h1"); err != nil || meta != (hostMeta{Cluster: "c1", Group: "g1"}) {
+		t.Errorf("unexpected metadata: %+v, %v", meta, err)
+	}
+
+	// hosts without metadata have no placement
+	if meta, err := readHostMeta("h2"); err != nil || meta != (hostMeta{}) {
+		t.Errorf("unexpected metadata: %+v, %v", meta, err)
+	}
+}
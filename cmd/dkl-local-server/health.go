@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"novit.nc/direktil/local-server/pkg/apiutils"
+)
+
+func registerHealthChecks() {
+	apiutils.AddReadinessCheck("config", checkConfig)
+	apiutils.AddReadinessCheck("secret-data", checkSecretData)
+	apiutils.AddReadinessCheck("cas", checkCAS)
+	apiutils.AddReadinessCheck("dist", checkDist)
+}
+
+func checkConfig() error {
+	_, err := readConfig()
+	return err
+}
+
+func checkSecretData() error {
+	// a missing file will be created on first use
+	_, _, err := readStoredSecretData(secretKey)
+	return err
+}
+
+func checkCAS() error {
+	dir := filepath.Join(*dataDir, "cache")
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write([]byte("ok"))
+	rmTempFile(f)
+
+	return err
+}
+
+// checkDist ensures the dist files needed by the hosts are local, or that the upstream can provide them.
+func checkDist() error {
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	needed := map[string]bool{}
+	for _, host := range cfg.Hosts {
+		needed[filepath.Join("kernels", host.Kernel)] = true
+		needed[filepath.Join("initrd", host.Initrd)] = true
+
+		for layer, version := range host.Versions {
+			needed[filepath.Join("layers", layer, version)] = true
+		}
+	}
+
+	paths := make([]string, 0, len(needed))
+	for path := range needed {
+		paths = append(paths, path)
+	}
+
+	return checkDistFiles(paths)
+}
+
+// checkDistFiles ensures every dist file is local, or available upstream.
+func checkDistFiles(paths []string) error {
+	missing := make([]string, 0)
+	for _, path := range paths {
+		if _, err := os.Stat(distFilePath(path)); err != nil {
+			missing = append(missing, path)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	sort.Strings(missing)
+
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	var (
+		wg          sync.WaitGroup
+		sem         = make(chan bool, 8) // concurrent requests
+		unavailable = make([]string, len(missing))
+	)
+
+	for i, path := range missing {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+
+			sem <- true
+			defer func() { <-sem }()
+
+			resp, err := client.Head(*upstreamURL + "/" + filepath.ToSlash(path))
+			if err != nil {
+				unavailable[i] = fmt.Sprintf("%s (%v)", path, err)
+				return
+			}
+
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				unavailable[i] = fmt.Sprintf("%s (%s)", path, resp.Status)
+			}
+		}(i, path)
+	}
+
+	wg.Wait()
+
+	errs := make([]string, 0)
+	for _, u := range unavailable {
+		if u != "" {
+			errs = append(errs, u)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d of %d missing dist files unavailable upstream: %s",
+		len(errs), len(missing), strings.Join(errs, ", "))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckDistFiles(t *testing.T) {
+	defer withDataDir(t)()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/kernels/upstream", "/layers/system/upstream":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	prev := *upstreamURL
+	defer func() { *upstreamURL = prev }()
+	*upstreamURL = upstream.URL
+
+	local := distFilePath("kernels", "local")
+	os.MkdirAll(filepath.Dir(local), 0755)
+	if f, err := os.Create(local); err != nil {
+		t.Fatal(err)
+	} else {
+		f.Close()
+	}
+
+	for _, tc := range []struct {
+		name  string
+		paths []string
+		error string
+	}{
+		{"none", nil, ""},
+		{"local", []string{"kernels/local"}, ""},
+		{"upstream", []string{"kernels/local", "kernels/upstream", "layers/system/upstream"}, ""},
+		// every file is checked, not only the first missing one
+		{"one unavailable", []string{"kernels/upstream", "layers/system/upstream", "layers/system/gone"},
+			"1 of 3 missing dist files unavailable upstream: layers/system/gone (404 Not Found)"},
+		{"all unavailable", []string{"initrd/a", "initrd/b"}, "2 of 2 missing"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkDistFiles(tc.paths)
+
+			if tc.error == "" {
+				if err != nil {
+					t.Error(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.error) {
+				t.Errorf("expected an error containing %q, got %v", tc.error, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/cloudflare/cfssl/csr"
+	restful "github.com/emicklei/go-restful"
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+var (
+	tlsClientAuth    = flag.String("tls-client-auth", "none", "HTTPS client certificate policy: none, request (verify if given) or require")
+	hostsCACluster   = flag.String("hosts-ca-cluster", "", "Cluster of the CA issuing the hosts' identity certificates (none disables host certificates)")
+	hostsCAName      = flag.String("hosts-ca", "hosts", "Name of the CA issuing the hosts' identity certificates (reserved: templates can only get its certificate)")
+	hostsCertProfile = flag.String("hosts-cert-profile", "client", "Signing profile of the hosts' identity certificates")
+)
+
+// hostFile is a host-specific file embedded in the host's boot media.
+type hostFile struct {
+	Name    string
+	Content []byte
+}
+
+// hostFiles returns the host's identity files: its token and, if enabled, its identity certificate.
+func (ctx *renderContext) hostFiles() (files []hostFile, err error) {
+	hostToken, err := ctx.secretData().HostToken(ctx.Host.Name)
+	if err != nil {
+		return
+	}
+
+	files = []hostFile{{"host-token", []byte(hostToken)}}
+
+	kc, ca, err := ctx.hostIdentity()
+	if err != nil || kc == nil {
+		return
+	}
+
+	files = append(files,
+		hostFile{"host-ca.crt", ca.Bundle()},
+		hostFile{"host.crt", kc.Cert},
+		hostFile{"host.key", kc.Key})
+
+	return
+}
+
+// hostIdentity returns the host's identity certificate, or nil if host certificates are disabled.
+func (ctx *renderContext) hostIdentity() (kc *KeyCert, ca *CA, err error) {
+	if *hostsCACluster == "" {
+		return
+	}
+
+	sd := ctx.secretData()
+
+	ca, err = sd.CA(*hostsCACluster, *hostsCAName)
+	if err != nil {
+		return
+	}
+
+	req := &csr.CertificateRequest{
+		CN:         ctx.Host.Name,
+		Hosts:      append([]string{ctx.Host.Name}, ctx.Host.IPs...),
+		KeyRequest: csr.NewBasicKeyRequest(),
+	}
+
+	kc, err = sd.KeyCert(*hostsCACluster, *hostsCAName, "host:"+ctx.Host.Name, *hostsCertProfile, "", req)
+	return
+}
+
+// serverTLSConfig returns the HTTPS listener's TLS config for the client certificate policy.
+func serverTLSConfig() (*tls.Config, error) {
+	var clientAuth tls.ClientAuthType
+
+	switch *tlsClientAuth {
+	case "none":
+		return nil, nil
+	case "request":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid TLS client auth: %q", *tlsClientAuth)
+	}
+
+	if *hostsCACluster == "" {
+		return nil, fmt.Errorf("TLS client auth %q requires -hosts-ca-cluster", *tlsClientAuth)
+	}
+
+	serverCert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = setupHostsCA(); err != nil {
+		// no config yet, the CA will be created by the first render
+		log.Print("TLS: hosts CA not available yet: ", err)
+	}
+
+	return &tls.Config{
+		// the pool follows the CA's changes (see updateHostsCAPool)
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    currentHostsCAPool(),
+			}, nil
+		},
+	}, nil
+}
+
+// setupHostsCA ensures the hosts CA exists, so the client certificates can be verified.
+func setupHostsCA() (err error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return
+	}
+
+	if err = loadSecretDataFor(cfg); err != nil {
+		return
+	}
+
+	if _, err = secretData.CA(*hostsCACluster, *hostsCAName); err != nil {
+		return
+	}
+
+	if secretData.Changed() {
+		// also updates the pool
+		return secretData.Save()
+	}
+
+	updateHostsCAPool(secretData)
+	return
+}
+
+var hostsCAPool struct {
+	l      sync.Mutex
+	bundle []byte
+	pool   *x509.CertPool
+}
+
+// currentHostsCAPool returns the pool verifying the hosts' certificates
+// (empty until the hosts CA exists).
+func currentHostsCAPool() *x509.CertPool {
+	hostsCAPool.l.Lock()
+	defer hostsCAPool.l.Unlock()
+
+	if hostsCAPool.pool == nil {
+		return x509.NewCertPool()
+	}
+
+	return hostsCAPool.pool
+}
+
+// updateHostsCAPool rebuilds the hosts CA pool if the CA's bundle changed.
+// It's called when the secret data is loaded or saved, and never creates the CA.
+func updateHostsCAPool(sd *SecretData) {
+	if *hostsCACluster == "" {
+		return
+	}
+
+	bundle := sd.FindCABundle(*hostsCACluster, *hostsCAName)
+	if bundle == nil {
+		return
+	}
+
+	hostsCAPool.l.Lock()
+	defer hostsCAPool.l.Unlock()
+
+	if bytes.Equal(bundle, hostsCAPool.bundle) {
+		return
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		log.Printf("TLS: no valid certificate in CA %s/%s", *hostsCACluster, *hostsCAName)
+		return
+	}
+
+	hostsCAPool.bundle = bundle
+	hostsCAPool.pool = pool
+}
+
+var errHostsCAReserved = errors.New("the hosts CA is reserved to the hosts' identity certificates")
+
+// isHostsCA checks if the CA is the one issuing the hosts' identity certificates.
+// Templates can't use its key: they could issue another host's identity.
+func isHostsCA(cluster, name string) bool {
+	return *hostsCACluster != "" && cluster == *hostsCACluster && name == *hostsCAName
+}
+
+// certHost returns the host identified by the request's verified client certificate, if any.
+func certHost(r *http.Request, cfg *localconfig.Config) *localconfig.Host {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if host := cfg.Host(name); host != nil {
+			return host
+		}
+	}
+
+	log.Printf("no host found for client certificate %q", cert.Subject.CommonName)
+	return nil
+}
+
+// hostCertAuth authenticates the request from its client certificate.
+func hostCertAuth(req *restful.Request) bool {
+	cfg, err := readConfig()
+	if err != nil {
+		return false
+	}
+
+	host := certHost(req.Request, cfg)
+	if host == nil {
+		return false
+	}
+
+	req.SetAttribute("host-name", host.Name)
+	return true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+// withHostsCA enables the host certificates, returning a function restoring the previous flags.
+func withHostsCA(cluster, name string) (restore func()) {
+	prevCluster, prevName := *hostsCACluster, *hostsCAName
+	*hostsCACluster, *hostsCAName = cluster, name
+
+	return func() { *hostsCACluster, *hostsCAName = prevCluster, prevName }
+}
+
+func TestIsHostsCA(t *testing.T) {
+	restore := withHostsCA("", "hosts")
+	if isHostsCA("", "hosts") {
+		t.Error("hosts CA while host certificates are disabled")
+	}
+	restore()
+
+	defer withHostsCA("c1", "hosts")()
+
+	for _, tc := range []struct {
+		cluster, name string
+		expect        bool
+	}{
+		{"c1", "hosts", true},
+		{"c2", "hosts", false},
+		{"c1", "other", false},
+	} {
+		if isHostsCA(tc.cluster, tc.name) != tc.expect {
+			t.Errorf("%s/%s: expected %v", tc.cluster, tc.name, tc.expect)
+		}
+	}
+}
+
+func TestTemplateFuncsRefuseHostsCA(t *testing.T) {
+	defer withHostsCA("c1", "hosts")()
+
+	sd := newTestSecretData()
+	ctx := &renderContext{Host: &localconfig.Host{Name: "h1"}, secrets: sd}
+	funcs := ctx.templateFuncs()
+
+	const req = `{"CN": "test"}`
+
+	for name, call := range map[string]func() (string, error){
+		"ca_key": func() (string, error) { return funcs["ca_key"].(func(string, string) (string, error))("c1", "hosts") },
+		"ca_dir": func() (string, error) { return funcs["ca_dir"].(func(string, string) (string, error))("c1", "hosts") },
+		"tls_key": func() (string, error) {
+			return funcs["tls_key"].(func(string, string, string, string, string, string) (string, error))("c1", "hosts", "n", "p", "", req)
+		},
+		"tls_crt": func() (string, error) {
+			return funcs["tls_crt"].(func(string, string, string, string, string, string) (string, error))("c1", "hosts", "n", "p", "", req)
+		},
+		"tls_crt_chain": func() (string, error) {
+			return funcs["tls_crt_chain"].(func(string, string, string, string, string, string) (string, error))("c1", "hosts", "n", "p", "", req)
+		},
+		"tls_dir": func() (string, error) {
+			return funcs["tls_dir"].(func(string, string, string, string, string, string, string) (string, error))("/d", "c1", "hosts", "n", "p", "", req)
+		},
+	} {
+		if _, err := call(); err != errHostsCAReserved {
+			t.Errorf("%s: expected errHostsCAReserved, got %v", name, err)
+		}
+	}
+
+	// refused before the CA could be created
+	if sd.FindCA("c1", "hosts") != nil {
+		t.Error("hosts CA created")
+	}
+}
+
+func TestCertHost(t *testing.T) {
+	cfg := &localconfig.Config{
+		Hosts: []*localconfig.Host{{Name: "h1"}, {Name: "h2"}},
+	}
+
+	request := func(cn string, dnsNames ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/me/config", nil)
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames},
+			}},
+		}
+		return r
+	}
+
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		expect string
+	}{
+		{"by CN", request("h1"), "h1"},
+		{"by SAN", request("other", "h2"), "h2"},
+		{"CN first", request("h1", "h2"), "h1"},
+		{"unknown", request("h3", "h4"), ""},
+		{"no TLS", httptest.NewRequest(http.MethodGet, "/me/config", nil), ""},
+		{
+			// unverified certificates are not in the verified chains
+			"not verified",
+			func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/me/config", nil)
+				r.TLS = &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "h1"}}},
+				}
+				return r
+			}(),
+			"",
+		},
+	} {
+		name := ""
+		if host := certHost(tc.req, cfg); host != nil {
+			name = host.Name
+		}
+
+		if name != tc.expect {
+			t.Errorf("%s: expected host %q, got %q", tc.name, tc.expect, name)
+		}
+	}
+}
+
+func TestServerTLSConfigErrors(t *testing.T) {
+	prev := *tlsClientAuth
+	defer func() { *tlsClientAuth = prev }()
+
+	defer withHostsCA("", "hosts")()
+
+	*tlsClientAuth = "none"
+	if cfg, err := serverTLSConfig(); cfg != nil || err != nil {
+		t.Errorf("unexpected result without client auth: %v, %v", cfg, err)
+	}
+
+	for _, policy := range []string{"invalid", "request", "require"} {
+		*tlsClientAuth = policy
+		if _, err := serverTLSConfig(); err == nil {
+			t.Errorf("%s: no error", policy)
+		}
+	}
+}
@@ -104,6 +104,22 @@ func buildInitrd(out io.Writer, ctx *renderContext) error {
 
 	archive.Write(ba)
 
+	// - the host identity
+	hostFiles, err := ctx.hostFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range hostFiles {
+		archive.WriteHeader(&cpio.Header{
+			Name: "boot/" + f.Name,
+			Mode: 0600,
+			Size: int64(len(f.Content)),
+		})
+
+		archive.Write(f.Content)
+	}
+
 	// finalize the archive
 	archive.Flush()
 	archive.Close()
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	buildWorkers  = flag.Int("build-workers", 2, "Number of background build workers")
+	buildKinds    = flag.String("build-kinds", "boot.img.lz4", "Comma-separated artifact kinds built by default by build jobs")
+	jobsHistory   = flag.Int("jobs-history", 1000, "Number of build jobs to remember")
+	jobsQueueSize = flag.Int("jobs-queue-size", 1000, "Maximum number of queued build jobs")
+
+	jobs = &jobQueue{}
+)
+
+type jobState string
+
+const (
+	jobQueued  jobState = "queued"
+	jobRunning jobState = "running"
+	jobDone    jobState = "done"
+	jobFailed  jobState = "failed"
+)
+
+type buildJob struct {
+	ID       string
+	Host     string
+	Kind     string
+	State    jobState
+	Error    string `json:",omitempty"`
+	Created  time.Time
+	Started  *time.Time `json:",omitempty"`
+	Finished *time.Time `json:",omitempty"`
+	Duration string     `json:",omitempty"`
+
+	log bytes.Buffer
+}
+
+type jobQueue struct {
+	l     sync.Mutex
+	jobs  []*buildJob
+	queue chan *buildJob
+}
+
+func startBuildWorkers() {
+	jobs.queue = make(chan *buildJob, *jobsQueueSize)
+
+	for i := 0; i < *buildWorkers; i++ {
+		go jobs.worker()
+	}
+}
+
+func defaultBuildKinds() []string {
+	return strings.Split(*buildKinds, ",")
+}
+
+var errQueueFull = errors.New("build queue is full")
+
+// Queue creates and queues a build job for each host and kind. If the queue
+// fills up, the jobs queued so far are returned with errQueueFull.
+func (q *jobQueue) Queue(hostNames, kinds []string) (queued []buildJob, err error) {
+	if len(kinds) == 0 {
+		kinds = defaultBuildKinds()
+	}
+
+	for _, kind := range kinds {
+		if _, ok := artifactBuilders[kind]; !ok {
+			return nil, fmt.Errorf("unknown artifact kind: %q", kind)
+		}
+	}
+
+	queued = make([]buildJob, 0, len(hostNames)*len(kinds))
+
+	for _, hostName := range hostNames {
+		for _, kind := range kinds {
+			job := &buildJob{
+				ID:      ulid(),
+				Host:    hostName,
+				Kind:    kind,
+				State:   jobQueued,
+				Created: time.Now(),
+			}
+
+			// in the history before a worker can update it
+			q.add(job)
+			snapshot := job.snapshot()
+
+			select {
+			case q.queue <- job:
+			default:
+				q.remove(job)
+				return queued, errQueueFull
+			}
+
+			queued = append(queued, snapshot)
+		}
+	}
+
+	return
+}
+
+func (q *jobQueue) add(job *buildJob) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	q.jobs = append(q.jobs, job)
+
+	if extra := len(q.jobs) - *jobsHistory; extra > 0 {
+		q.jobs = q.jobs[extra:]
+	}
+}
+
+func (q *jobQueue) remove(job *buildJob) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	for i, j := range q.jobs {
+		if j == job {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// List returns a snapshot of the known jobs, oldest first.
+func (q *jobQueue) List() []buildJob {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	list := make([]buildJob, len(q.jobs))
+	for i, job := range q.jobs {
+		list[i] = job.snapshot()
+	}
+
+	return list
+}
+
+// Get returns a snapshot of the job and its log.
+func (q *jobQueue) Get(id string) (job buildJob, jobLog []byte, found bool) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	for _, j := range q.jobs {
+		if j.ID == id {
+			return j.snapshot(), append([]byte{}, j.log.Bytes()...), true
+		}
+	}
+
+	return
+}
+
+func (q *jobQueue) update(job *buildJob, update func()) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	update()
+}
+
+func (q *jobQueue) logf(job *buildJob, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("job %s: %s", job.ID, msg)
+
+	q.update(job, func() {
+		fmt.Fprintf(&job.log, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+	})
+}
+
+func (job *buildJob) snapshot() buildJob {
+	return buildJob{
+		ID:       job.ID,
+		Host:     job.Host,
+		Kind:     job.Kind,
+		State:    job.State,
+		Error:    job.Error,
+		Created:  job.Created,
+		Started:  job.Started,
+		Finished: job.Finished,
+		Duration: job.Duration,
+	}
+}
+
+func (q *jobQueue) worker() {
+	for job := range q.queue {
+		start := time.Now()
+		q.update(job, func() {
+			job.State = jobRunning
+			job.Started = &start
+		})
+
+		err := q.run(job)
+
+		end := time.Now()
+		duration := end.Sub(start).String()
+
+		q.update(job, func() {
+			job.Finished = &end
+			job.Duration = duration
+
+			if err != nil {
+				job.State = jobFailed
+				job.Error = err.Error()
+			} else {
+				job.State = jobDone
+			}
+		})
+
+		if err != nil {
+			q.logf(job, "failed: %v", err)
+		} else {
+			q.logf(job, "done in %s", duration)
+		}
+	}
+}
+
+func (q *jobQueue) run(job *buildJob) (err error) {
+	q.logf(job, "building %s for host %s", job.Kind, job.Host)
+
+	cfg, err := readConfig()
+	if err != nil {
+		return
+	}
+
+	host := cfg.Host(job.Host)
+	if host == nil {
+		return fmt.Errorf("no host named %q", job.Host)
+	}
+
+	ctx, err := newRenderContext(host, cfg)
+	if err != nil {
+		return
+	}
+
+	tag, err := ctx.Tag()
+	if err != nil {
+		return
+	}
+
+	q.logf(job, "tag: %s", tag)
+
+	content, meta, err := ctx.getOrBuild(tag, job.Kind, measureBuild(job.Kind, artifactBuilders[job.Kind]))
+	if err != nil {
+		return
+	}
+
+	if c, ok := content.(io.Closer); ok {
+		c.Close()
+	}
+
+	q.logf(job, "%s is available (%d bytes)", job.Kind, meta.Size())
+	return
+}
+
+// changedHosts returns the names of the hosts of cfg whose tag is not in previousTags.
+func changedHosts(previousTags map[string]string) (hostNames []string, err error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return
+	}
+
+	hostNames = make([]string, 0)
+	for _, host := range cfg.Hosts {
+		tag, err := hostTag(host, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %v", host.Name, err)
+		}
+
+		if previousTags[host.Name] != tag {
+			hostNames = append(hostNames, host.Name)
+		}
+	}
+
+	return
+}
+
+// currentTags returns the current tag of each host.
+func currentTags() (tags map[string]string, err error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return
+	}
+
+	tags = make(map[string]string, len(cfg.Hosts))
+	for _, host := range cfg.Hosts {
+		tag, err := hostTag(host, cfg)
+		if err != nil {
+			// the host will be seen as changed
+			log.Printf("host %s: failed to compute the tag: %v", host.Name, err)
+			continue
+		}
+
+		tags[host.Name] = tag
+	}
+
+	return
+}
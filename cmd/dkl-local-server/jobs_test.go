@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// withJobQueue uses a job queue of the given size without workers, returning a function restoring the previous one.
+func withJobQueue(size int) (restore func()) {
+	initUlid()
+
+	prev := jobs
+	jobs = &jobQueue{queue: make(chan *buildJob, size)}
+
+	return func() { jobs = prev }
+}
+
+func TestJobQueue(t *testing.T) {
+	defer withJobQueue(2)()
+
+	if _, err := jobs.Queue([]string{"h1"}, []string{"unknown"}); err == nil {
+		t.Error("no error with an unknown kind")
+	}
+
+	queued, err := jobs.Queue([]string{"h1", "h2", "h3"}, nil)
+	if err != errQueueFull {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+
+	if len(queued) != 2 || queued[0].Host != "h1" || queued[1].Host != "h2" {
+		t.Fatalf("unexpected queued jobs: %+v", queued)
+	}
+
+	// the history has exactly the queued jobs
+	list := jobs.List()
+	if len(list) != len(queued) {
+		t.Fatalf("unexpected history: %+v", list)
+	}
+
+	for i, job := range list {
+		if job.ID != queued[i].ID || job.State != jobQueued {
+			t.Errorf("unexpected job: %+v", job)
+		}
+
+		if queuedJob := <-jobs.queue; queuedJob.ID != job.ID {
+			t.Errorf("job %s not queued in order", job.ID)
+		}
+	}
+}
+
+func TestQueueBuildsQueueFull(t *testing.T) {
+	defer withConfig(t)()
+	defer withJobQueue(2)()
+
+	writeTestConfig(t, `
+hosts: [{name: h1}, {name: h2}, {name: h3}]
+host_meta:
+  h1: {cluster: c1}
+  h2: {cluster: c1}
+  h3: {cluster: c1}
+`)
+
+	ws := (&restful.WebService{}).Produces(restful.MIME_JSON)
+	ws.Route(ws.POST("/clusters/{cluster-name}/builds").To(wsQueueClusterBuilds).
+		Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+			req.SetAttribute("admin", &adminCredential{Name: "test", Scopes: []string{scopeAll}})
+			chain.ProcessFilter(req, resp)
+		}))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clusters/c1/builds", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+
+	result := queuedBuilds{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Error != errQueueFull.Error() || len(result.Queued) != 2 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
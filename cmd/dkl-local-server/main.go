@@ -8,6 +8,7 @@ import (
 
 	restful "github.com/emicklei/go-restful"
 	"github.com/mcluseau/go-swagger-ui"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"novit.nc/direktil/pkg/cas"
 
 	"novit.nc/direktil/local-server/pkg/apiutils"
@@ -29,27 +30,101 @@ var (
 func main() {
 	flag.Parse()
 
+	initUlid()
+
+	if err := loadSecretKey(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupSecretStore(); err != nil {
+		log.Fatal("failed to setup the secret store: ", err)
+	}
+
+	// backups only read the data dir (locking the config files against uploads), they can be made while the server runs
+	if *backupTo != "" {
+		if err := backupToFile(*backupTo); err != nil {
+			log.Fatal("backup failed: ", err)
+		}
+		return
+	}
+
+	if err := lockDataDir(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *rekeySecretDataTo != "" {
+		if err := rekeySecretData(*rekeySecretDataTo); err != nil {
+			log.Fatal("failed to re-key secret data: ", err)
+		}
+		return
+	}
+
+	if *restoreFrom != "" {
+		if err := restoreBackup(*restoreFrom); err != nil {
+			log.Fatal("restore failed: ", err)
+		}
+		return
+	}
+
 	if *address == "" && *tlsAddress == "" {
 		log.Fatal("no listen address given")
 	}
 
+	if err := setupTrustedProxies(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadAdminCredentials(); err != nil {
+		log.Fatal("failed to load admin credentials: ", err)
+	}
+
+	if err := loadCAConfig(); err != nil {
+		log.Fatal("failed to load the CA config: ", err)
+	}
+
+	if err := loadConfigSigners(); err != nil {
+		log.Fatal("failed to load config signers: ", err)
+	}
+
+	setupBuildLimits()
+	startBuildWorkers()
+
 	casStore = cas.NewDir(filepath.Join(*dataDir, "cache"))
+	go configWatcher()
 	go casCleaner()
+	go certRenewer()
+	if *secretStoreKind != "file" {
+		// the file store is only used by this server
+		go secretDataRefresher()
+	}
+
+	registerHealthChecks()
 
 	apiutils.Setup(func() {
 		registerWS(restful.DefaultContainer)
 	})
 
 	swaggerui.HandleAt("/swagger-ui/")
+	http.Handle("/metrics", promhttp.Handler())
 
 	if *address != "" {
 		log.Print("HTTP listening on ", *address)
-		go log.Fatal(http.ListenAndServe(*address, nil))
+		go func() { log.Fatal(http.ListenAndServe(*address, nil)) }()
 	}
 
 	if *tlsAddress != "" {
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		srv := &http.Server{
+			Addr:      *tlsAddress,
+			TLSConfig: tlsConfig,
+		}
+
 		log.Print("HTTPS listening on ", *tlsAddress)
-		go log.Fatal(http.ListenAndServeTLS(*tlsAddress, *certFile, *keyFile, nil))
+		go func() { log.Fatal(srv.ListenAndServeTLS(*certFile, *keyFile)) }()
 	}
 
 	select {}
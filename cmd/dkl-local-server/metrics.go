@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "dkl_local_server"
+
+var (
+	requestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "API requests by route and response code",
+	}, []string{"method", "route", "code"})
+
+	artifactRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "artifact_requests_total",
+		Help:      "Host artifact requests by kind",
+	}, []string{"kind"})
+
+	casRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cas_requests_total",
+		Help:      "CAS lookups by artifact kind and result (hit or miss)",
+	}, []string{"kind", "result"})
+
+	buildDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_duration_seconds",
+		Help:      "Artifact build durations by kind",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"kind", "result"})
+
+	distFetchBytesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dist_fetch_bytes_total",
+		Help:      "Bytes fetched from the upstream dist server",
+	})
+
+	distFetchDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "dist_fetch_duration_seconds",
+		Help:      "Upstream dist fetch durations",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"result"})
+
+	distFetchChecksumFailuresMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dist_fetch_checksum_failures_total",
+		Help:      "Upstream dist fetches rejected because of a checksum mismatch",
+	})
+
+	casRemovedTagsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cas_removed_tags_total",
+		Help:      "Tags removed by the CAS cleaner",
+	})
+
+	secretDataSavesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_data_saves_total",
+		Help:      "Secret data saves by result",
+	}, []string{"result"})
+
+	certRenewalsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_renewals_total",
+		Help:      "Certificates renewed because of their expiry",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsMetric,
+		artifactRequestsMetric,
+		casRequestsMetric,
+		buildDurationMetric,
+		distFetchBytesMetric,
+		distFetchDurationMetric,
+		distFetchChecksumFailuresMetric,
+		casRemovedTagsMetric,
+		secretDataSavesMetric,
+		certRenewalsMetric,
+	)
+}
+
+func metricsFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	chain.ProcessFilter(req, resp)
+
+	requestsMetric.WithLabelValues(
+		req.Request.Method,
+		req.SelectedRoutePath(),
+		strconv.Itoa(resp.StatusCode())).Inc()
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// measureBuild wraps a build function to record its duration.
+func measureBuild(kind string, build func(out io.Writer, ctx *renderContext) error) func(out io.Writer, ctx *renderContext) error {
+	return func(out io.Writer, ctx *renderContext) (err error) {
+		start := time.Now()
+		err = build(out, ctx)
+
+		buildDurationMetric.WithLabelValues(kind, resultLabel(err)).
+			Observe(time.Since(start).Seconds())
+
+		return
+	}
+}
@@ -5,16 +5,22 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
 
 	cfsslconfig "github.com/cloudflare/cfssl/config"
 	"github.com/cloudflare/cfssl/csr"
+	"golang.org/x/sync/singleflight"
 	yaml "gopkg.in/yaml.v2"
 
 	"novit.nc/direktil/pkg/config"
@@ -24,6 +30,46 @@ import (
 type renderContext struct {
 	Host      *localconfig.Host
 	SSLConfig string
+
+	// secrets overrides the secret data (ie: for dry runs)
+	secrets *SecretData
+
+	secretsLock sync.Mutex
+	secretsUsed map[string]bool
+}
+
+// secretData returns the secret data used by the render.
+func (ctx *renderContext) secretData() *SecretData {
+	if ctx.secrets != nil {
+		return ctx.secrets
+	}
+	return secretData
+}
+
+// useSecret records that secret material was emitted by the render.
+func (ctx *renderContext) useSecret(kind string, args ...string) {
+	ctx.secretsLock.Lock()
+	defer ctx.secretsLock.Unlock()
+
+	if ctx.secretsUsed == nil {
+		ctx.secretsUsed = make(map[string]bool)
+	}
+
+	ctx.secretsUsed[kind+" "+strings.Join(args, "/")] = true
+}
+
+// SecretsUsed returns the secret material emitted by the render.
+func (ctx *renderContext) SecretsUsed() (secrets []string) {
+	ctx.secretsLock.Lock()
+	defer ctx.secretsLock.Unlock()
+
+	secrets = make([]string, 0, len(ctx.secretsUsed))
+	for secret := range ctx.secretsUsed {
+		secrets = append(secrets, secret)
+	}
+
+	sort.Strings(secrets)
+	return
 }
 
 func renderCtx(w http.ResponseWriter, r *http.Request, ctx *renderContext, what string,
@@ -36,23 +82,90 @@ func renderCtx(w http.ResponseWriter, r *http.Request, ctx *renderContext, what
 	}
 
 	// get it or create it
-	content, meta, err := casStore.GetOrCreate(tag, what, func(out io.Writer) error {
-		log.Printf("building %s for %q", what, ctx.Host.Name)
-		return create(out, ctx)
-	})
-
+	content, meta, err := ctx.getOrBuild(tag, what, create)
 	if err != nil {
 		return err
 	}
 
+	if c, ok := content.(io.Closer); ok {
+		defer c.Close()
+	}
+
 	// serve it
 	http.ServeContent(w, r, what, meta.ModTime(), content)
 	return nil
 }
 
-var prevSSLConfig = "-"
+var buildGroup singleflight.Group
+
+// getOrBuild returns the CAS entry for the tag and kind, building it if needed.
+// Concurrent requests for the same entry wait for a single build.
+func (ctx *renderContext) getOrBuild(tag, what string,
+	create func(out io.Writer, ctx *renderContext) error) (content io.ReadSeeker, meta os.FileInfo, err error) {
+
+	build := func(out io.Writer) error {
+		log.Printf("building %s for %q", what, ctx.Host.Name)
+		return create(out, ctx)
+	}
+
+	built := false
+	_, err, shared := buildGroup.Do(tag+"/"+what, func() (interface{}, error) {
+		content, _, err := casStore.GetOrCreate(tag, what, func(out io.Writer) error {
+			built = true
+			return build(out)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c, ok := content.(io.Closer); ok {
+			c.Close()
+		}
+
+		return nil, nil
+	})
+
+	switch {
+	case built:
+		casRequestsMetric.WithLabelValues(what, "miss").Inc()
+	case shared:
+		casRequestsMetric.WithLabelValues(what, "wait").Inc()
+	default:
+		casRequestsMetric.WithLabelValues(what, "hit").Inc()
+	}
+
+	if err != nil {
+		return
+	}
+
+	// the entry is now in the store (unless cleaned in between, then it's rebuilt)
+	return casStore.GetOrCreate(tag, what, build)
+}
+
+var (
+	prevSSLConfig = "-"
+
+	// secretDataLoadMutex serializes the (re)loads of the secret data
+	secretDataLoadMutex sync.Mutex
+)
 
 func newRenderContext(host *localconfig.Host, cfg *localconfig.Config) (ctx *renderContext, err error) {
+	if err = loadSecretDataFor(cfg); err != nil {
+		return
+	}
+
+	return &renderContext{
+		SSLConfig: cfg.SSLConfig,
+		Host:      host,
+	}, nil
+}
+
+// loadSecretDataFor (re)loads the secret data when the SSL config changes.
+func loadSecretDataFor(cfg *localconfig.Config) (err error) {
+	secretDataLoadMutex.Lock()
+	defer secretDataLoadMutex.Unlock()
+
 	if prevSSLConfig != cfg.SSLConfig {
 		var sslCfg *cfsslconfig.Config
 
@@ -73,26 +186,15 @@ func newRenderContext(host *localconfig.Host, cfg *localconfig.Config) (ctx *ren
 		prevSSLConfig = cfg.SSLConfig
 	}
 
-	return &renderContext{
-		SSLConfig: cfg.SSLConfig,
-		Host:      host,
-	}, nil
+	return
 }
 
 func (ctx *renderContext) Config() (ba []byte, cfg *config.Config, err error) {
-	tmpl, err := template.New(ctx.Host.Name + "/config").
-		Funcs(ctx.templateFuncs()).
-		Parse(ctx.Host.Config)
-
+	ba, err = ctx.renderConfigTemplate(ctx.templateFuncs())
 	if err != nil {
 		return
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, 4096))
-	if err = tmpl.Execute(buf, nil); err != nil {
-		return
-	}
-
 	if secretData.Changed() {
 		err = secretData.Save()
 		if err != nil {
@@ -100,19 +202,42 @@ func (ctx *renderContext) Config() (ba []byte, cfg *config.Config, err error) {
 		}
 	}
 
-	ba = buf.Bytes()
-
 	cfg = &config.Config{}
 
-	if err = yaml.Unmarshal(buf.Bytes(), cfg); err != nil {
+	if err = yaml.Unmarshal(ba, cfg); err != nil {
+		return
+	}
+
+	return
+}
+
+// renderConfigTemplate executes the host's config template with the given functions.
+func (ctx *renderContext) renderConfigTemplate(funcs map[string]interface{}) (ba []byte, err error) {
+	tmpl, err := template.New(ctx.Host.Name + "/config").
+		Funcs(funcs).
+		Parse(ctx.Host.Config)
+
+	if err != nil {
+		return
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 4096))
+	if err = tmpl.Execute(buf, nil); err != nil {
 		return
 	}
 
+	ba = buf.Bytes()
 	return
 }
 
 func (ctx *renderContext) templateFuncs() map[string]interface{} {
+	sd := ctx.secretData()
+
 	getKeyCert := func(cluster, caName, name, profile, label, reqJson string) (kc *KeyCert, err error) {
+		if isHostsCA(cluster, caName) {
+			return nil, errHostsCAReserved
+		}
+
 		certReq := &csr.CertificateRequest{
 			KeyRequest: csr.NewBasicKeyRequest(),
 		}
@@ -123,21 +248,46 @@ func (ctx *renderContext) templateFuncs() map[string]interface{} {
 			return
 		}
 
-		return secretData.KeyCert(cluster, caName, name, profile, label, certReq)
+		return sd.KeyCert(cluster, caName, name, profile, label, certReq)
 	}
 
-	asYaml := func(v interface{}) (string, error) {
-		ba, err := yaml.Marshal(v)
-		if err != nil {
-			return "", err
-		}
+	return map[string]interface{}{
+		"host_token": func() (string, error) {
+			return sd.HostToken(ctx.Host.Name)
+		},
 
-		return string(ba), nil
-	}
+		"host_crt": func() (s string, err error) {
+			kc, _, err := ctx.hostIdentity()
+			if err == nil && kc == nil {
+				err = errors.New("host certificates are not enabled")
+			}
+			if err != nil {
+				return
+			}
+
+			s = string(kc.Cert)
+			return
+		},
+
+		"host_key": func() (s string, err error) {
+			ctx.useSecret("host_key", ctx.Host.Name)
+
+			kc, _, err := ctx.hostIdentity()
+			if err == nil && kc == nil {
+				err = errors.New("host certificates are not enabled")
+			}
+			if err != nil {
+				return
+			}
+
+			s = string(kc.Key)
+			return
+		},
 
-	return map[string]interface{}{
 		"password": func(cluster, name string) (password string, err error) {
-			password = secretData.Password(cluster, name)
+			ctx.useSecret("password", cluster, name)
+
+			password = sd.Password(cluster, name)
 			if len(password) == 0 {
 				err = fmt.Errorf("password %q not defined for cluster %q", name, cluster)
 			}
@@ -145,11 +295,17 @@ func (ctx *renderContext) templateFuncs() map[string]interface{} {
 		},
 
 		"token": func(cluster, name string) (s string, err error) {
-			return secretData.Token(cluster, name)
+			return sd.Token(cluster, name)
 		},
 
 		"ca_key": func(cluster, name string) (s string, err error) {
-			ca, err := secretData.CA(cluster, name)
+			ctx.useSecret("ca_key", cluster, name)
+
+			if isHostsCA(cluster, name) {
+				return "", errHostsCAReserved
+			}
+
+			ca, err := sd.CA(cluster, name)
 			if err != nil {
 				return
 			}
@@ -159,17 +315,33 @@ func (ctx *renderContext) templateFuncs() map[string]interface{} {
 		},
 
 		"ca_crt": func(cluster, name string) (s string, err error) {
-			ca, err := secretData.CA(cluster, name)
+			ca, err := sd.CA(cluster, name)
 			if err != nil {
 				return
 			}
 
-			s = string(ca.Cert)
+			s = string(ca.Bundle())
+			return
+		},
+
+		"ca_chain": func(cluster, name string) (s string, err error) {
+			ca, err := sd.CA(cluster, name)
+			if err != nil {
+				return
+			}
+
+			s = string(pemBundle(ca.Cert, ca.Chain))
 			return
 		},
 
 		"ca_dir": func(cluster, name string) (s string, err error) {
-			ca, err := secretData.CA(cluster, name)
+			ctx.useSecret("ca_key", cluster, name)
+
+			if isHostsCA(cluster, name) {
+				return "", errHostsCAReserved
+			}
+
+			ca, err := sd.CA(cluster, name)
 			if err != nil {
 				return
 			}
@@ -180,7 +352,7 @@ func (ctx *renderContext) templateFuncs() map[string]interface{} {
 				{
 					Path:    path.Join(dir, "ca.crt"),
 					Mode:    0644,
-					Content: string(ca.Cert),
+					Content: string(ca.Bundle()),
 				},
 				{
 					Path:    path.Join(dir, "ca.key"),
@@ -191,6 +363,8 @@ func (ctx *renderContext) templateFuncs() map[string]interface{} {
 		},
 
 		"tls_key": func(cluster, caName, name, profile, label, reqJson string) (s string, err error) {
+			ctx.useSecret("tls_key", cluster, caName, name)
+
 			kc, err := getKeyCert(cluster, caName, name, profile, label, reqJson)
 			if err != nil {
 				return
@@ -210,27 +384,46 @@ func (ctx *renderContext) templateFuncs() map[string]interface{} {
 			return
 		},
 
-		"tls_dir": func(dir, cluster, caName, name, profile, label, reqJson string) (s string, err error) {
-			ca, err := secretData.CA(cluster, caName)
+		"tls_crt_chain": func(cluster, caName, name, profile, label, reqJson string) (s string, err error) {
+			// getKeyCert first: it refuses the hosts CA
+			kc, err := getKeyCert(cluster, caName, name, profile, label, reqJson)
+			if err != nil {
+				return
+			}
+
+			ca, err := sd.CA(cluster, caName)
 			if err != nil {
 				return
 			}
 
+			s = string(pemBundle(kc.Cert, ca.Cert, ca.Chain))
+			return
+		},
+
+		"tls_dir": func(dir, cluster, caName, name, profile, label, reqJson string) (s string, err error) {
+			ctx.useSecret("tls_key", cluster, caName, name)
+
+			// getKeyCert first: it refuses the hosts CA
 			kc, err := getKeyCert(cluster, caName, name, profile, label, reqJson)
 			if err != nil {
 				return
 			}
 
+			ca, err := sd.CA(cluster, caName)
+			if err != nil {
+				return
+			}
+
 			return asYaml([]config.FileDef{
 				{
 					Path:    path.Join(dir, "ca.crt"),
 					Mode:    0644,
-					Content: string(ca.Cert),
+					Content: string(ca.Bundle()),
 				},
 				{
 					Path:    path.Join(dir, "tls.crt"),
 					Mode:    0644,
-					Content: string(kc.Cert),
+					Content: string(ca.CertChain(kc.Cert)),
 				},
 				{
 					Path:    path.Join(dir, "tls.key"),
@@ -243,12 +436,22 @@ func (ctx *renderContext) templateFuncs() map[string]interface{} {
 }
 
 func (ctx *renderContext) distFilePath(path ...string) string {
+	return distFilePath(path...)
+}
+
+func distFilePath(path ...string) string {
 	return filepath.Join(append([]string{*dataDir, "dist"}, path...)...)
 }
 
 func (ctx *renderContext) Tag() (string, error) {
 	h := sha256.New()
 
+	// the host identity is embedded in the boot media
+	hostFiles, err := ctx.hostFiles()
+	if err != nil {
+		return "", err
+	}
+
 	_, cfg, err := ctx.Config()
 	if err != nil {
 		return "", err
@@ -256,7 +459,7 @@ func (ctx *renderContext) Tag() (string, error) {
 
 	enc := yaml.NewEncoder(h)
 
-	for _, o := range []interface{}{cfg, ctx} {
+	for _, o := range []interface{}{cfg, ctx, hash(hostFiles)} {
 		if err := enc.Encode(o); err != nil {
 			return "", err
 		}
@@ -265,6 +468,15 @@ func (ctx *renderContext) Tag() (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+func asYaml(v interface{}) (string, error) {
+	ba, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(ba), nil
+}
+
 func asMap(v interface{}) map[string]interface{} {
 	ba, err := yaml.Marshal(v)
 	if err != nil {
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+var (
+	restoreFrom = flag.String("restore", "", "Restore the server state from this backup (- for stdin), then exit (the server must be stopped)")
+	restoreKey  = flag.String("restore-key", "", "RSA private key (PEM) to decrypt the backup's secrets")
+)
+
+// restoreBackup runs the -restore CLI mode: the backup is extracted and verified
+// next to the data dir, which is replaced only if everything is valid.
+// The replaced data dir is kept as <data dir>.before-restore-<id>.
+func restoreBackup(src string) (err error) {
+	var in io.Reader = os.Stdin
+	if src != "-" {
+		var f *os.File
+		f, err = os.Open(src)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var priv *rsa.PrivateKey
+	if *restoreKey != "" {
+		priv, err = readRestoreKey(*restoreKey)
+		if err != nil {
+			return
+		}
+	}
+
+	dataPath := filepath.Clean(*dataDir)
+	id := ulid()
+
+	staging := dataPath + ".restore-" + id
+	if err = os.Mkdir(staging, 0700); err != nil {
+		return
+	}
+
+	// the staging dir holds only the backup's data until it's swapped in
+	defer func() {
+		if err != nil {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	manifest, files, err := extractBackup(in, staging)
+	if err != nil {
+		return
+	}
+
+	if err = verifyBackup(manifest, files); err != nil {
+		return
+	}
+
+	if _, err = localconfig.FromFile(filepath.Join(staging, "config.yaml")); err != nil {
+		return fmt.Errorf("invalid config in backup: %v", err)
+	}
+
+	secrets, err := restoredSecrets(staging, priv)
+	if err != nil {
+		return
+	}
+
+	if secrets != nil {
+		stagedSecrets := filepath.Join(staging, "secret-data.json")
+
+		if *secretStoreKind == "file" {
+			err = ioutil.WriteFile(stagedSecrets, secrets, 0600)
+		} else {
+			// stored elsewhere, see below
+			err = os.Remove(stagedSecrets)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// secrets stored elsewhere are written first, and put back if the data dir can't be replaced
+	if secrets != nil && *secretStoreKind != "file" {
+		var prevSecrets []byte
+		prevSecrets, err = secretStorage.Load()
+		if err != nil {
+			return
+		}
+
+		if err = secretStorage.Save(secrets); err != nil {
+			return fmt.Errorf("failed to store the restored secret data: %v", err)
+		}
+
+		defer func() {
+			if err == nil {
+				return
+			}
+
+			if prevSecrets == nil {
+				log.Print("warning: the secret store had no data, the restored secret data was left in it")
+			} else if err2 := secretStorage.Save(prevSecrets); err2 != nil {
+				log.Print("failed to put the previous secret data back in the store: ", err2)
+			}
+		}()
+	}
+
+	previous := dataPath + ".before-restore-" + id
+	if err = swapDataDir(dataPath, staging, previous); err != nil {
+		return
+	}
+
+	// move back what's not part of the backups; the lock first, so the data dir stays locked
+	keep := []string{".lock", "cache", "audit.log"}
+	if !hasBackupDir(files, "dist") {
+		keep = append(keep, "dist")
+	}
+
+	for _, name := range keep {
+		err := os.Rename(filepath.Join(previous, name), filepath.Join(dataPath, name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("warning: failed to move %s from the previous data, it's left in %s: %v", name, previous, err)
+		}
+	}
+
+	log.Print("restored the backup, the previous data is in ", previous)
+	return
+}
+
+// swapDataDir replaces the data dir with the staged one, keeping the data dir
+// as previous. On error, the data dir is left (or put back) in place.
+func swapDataDir(dataPath, staging, previous string) (err error) {
+	if err = os.Rename(dataPath, previous); err != nil {
+		if !os.IsNotExist(err) {
+			return
+		}
+
+		// no data dir to keep
+		return os.Rename(staging, dataPath)
+	}
+
+	if err = os.Rename(staging, dataPath); err != nil {
+		if err2 := os.Rename(previous, dataPath); err2 != nil {
+			return fmt.Errorf("%v (and failed to put the data dir back from %s: %v)", err, previous, err2)
+		}
+		return
+	}
+
+	return
+}
+
+// extractBackup extracts a backup in dir, returning its manifest and the extracted files.
+func extractBackup(in io.Reader, dir string) (manifest *backupManifest, extracted map[string]backupFile, err error) {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return
+	}
+
+	tr := tar.NewReader(gz)
+
+	extracted = map[string]backupFile{}
+
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+
+		if manifest != nil {
+			return nil, nil, errors.New("invalid backup: entries after the manifest")
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return nil, nil, fmt.Errorf("invalid backup: %s is not a regular file", hdr.Name)
+		}
+
+		if hdr.Name == backupManifestName {
+			manifest = &backupManifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("invalid backup manifest: %v", err)
+			}
+			continue
+		}
+
+		if !validBackupPath(hdr.Name) {
+			return nil, nil, fmt.Errorf("invalid backup: unexpected file %q", hdr.Name)
+		}
+
+		if _, dup := extracted[hdr.Name]; dup {
+			return nil, nil, fmt.Errorf("invalid backup: duplicate file %s", hdr.Name)
+		}
+
+		var f backupFile
+		f, err = extractBackupFile(tr, hdr, dir)
+		if err != nil {
+			return
+		}
+
+		extracted[hdr.Name] = f
+	}
+
+	if manifest == nil {
+		return nil, nil, errors.New("invalid backup: no manifest (truncated?)")
+	}
+
+	if manifest.Version != backupVersion {
+		return nil, nil, fmt.Errorf("unsupported backup version: %d", manifest.Version)
+	}
+
+	return
+}
+
+func extractBackupFile(tr *tar.Reader, hdr *tar.Header, dir string) (f backupFile, err error) {
+	target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(hdr.Mode).Perm()|0600)
+	if err != nil {
+		return
+	}
+
+	h := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(out, h), tr)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+
+	os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+
+	return backupFile{
+		Path:   hdr.Name,
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// validBackupPath checks that a backup's file is part of what backups contain.
+func validBackupPath(name string) bool {
+	if name != path.Clean(name) || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+		return false
+	}
+
+	switch name {
+	case "config.yaml", "config.meta.json", backupSecretsName, backupSecretsEncName:
+		return true
+	}
+
+	return strings.HasPrefix(name, "archives/") || strings.HasPrefix(name, "dist/")
+}
+
+// verifyBackup checks the extracted files against the manifest: no missing, altered or extra file.
+func verifyBackup(manifest *backupManifest, files map[string]backupFile) error {
+	listed := map[string]bool{}
+
+	for _, f := range manifest.Files {
+		if files[f.Path] != f {
+			return fmt.Errorf("invalid backup: %s is missing or doesn't match its checksum", f.Path)
+		}
+		listed[f.Path] = true
+	}
+
+	for name := range files {
+		if !listed[name] {
+			return fmt.Errorf("invalid backup: %s is not in the manifest", name)
+		}
+	}
+
+	if !listed["config.yaml"] {
+		return errors.New("invalid backup: no config")
+	}
+
+	return nil
+}
+
+func hasBackupDir(files map[string]backupFile, dir string) bool {
+	for name := range files {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// restoredSecrets returns the stored form of the backup's secret data, after checking it can be read.
+func restoredSecrets(dir string, priv *rsa.PrivateKey) (stored []byte, err error) {
+	encPath := filepath.Join(dir, backupSecretsEncName)
+
+	stored, err = ioutil.ReadFile(filepath.Join(dir, backupSecretsName))
+	if os.IsNotExist(err) {
+		var enc []byte
+		enc, err = ioutil.ReadFile(encPath)
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return
+		}
+
+		stored, err = decryptBackupSecrets(enc, priv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the backup's secrets: %v", err)
+		}
+
+		if err = os.Remove(encPath); err != nil {
+			return
+		}
+
+	} else if err != nil {
+		return
+	}
+
+	plain, _, err := openSecretData(stored, secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret data in backup: %v", err)
+	}
+
+	if _, err = decodeSecretData(plain); err != nil {
+		return nil, fmt.Errorf("invalid secret data in backup: %v", err)
+	}
+
+	return
+}
+
+func readRestoreKey(path string) (priv *rsa.PrivateKey, err error) {
+	ba, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	block, _ := pem.Decode(ba)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA private key (%T)", path, key)
+	}
+
+	return
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+var (
+	vaultAddr      = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "Vault address, for -secret-store=vault")
+	vaultMount     = flag.String("vault-mount", "secret", "Vault KV v2 mount, for -secret-store=vault")
+	vaultPath      = flag.String("vault-path", "direktil/secret-data", "Vault KV v2 path of the secret data, for -secret-store=vault")
+	vaultTokenFile = flag.String("vault-token-file", "", "File containing the Vault token (defaults to the VAULT_TOKEN environment variable)")
+
+	errVaultCASMismatch = errors.New("vault: check-and-set version mismatch")
+)
+
+// vaultSecretStore is a secretStore in a Vault KV (version 2) secret.
+// Updates use the check-and-set versions so concurrent servers don't overwrite each other.
+type vaultSecretStore struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+var _ secretStore = &vaultSecretStore{}
+
+// vaultSecret is the KV v2 secret's data
+type vaultSecret struct {
+	SecretData string `json:"secret_data"`
+}
+
+func newVaultSecretStore() (s *vaultSecretStore, err error) {
+	if *vaultAddr == "" {
+		return nil, errors.New("vault: no address given")
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if *vaultTokenFile != "" {
+		ba, err := ioutil.ReadFile(*vaultTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(ba))
+	}
+
+	if token == "" {
+		return nil, errors.New("vault: no token given")
+	}
+
+	return &vaultSecretStore{
+		url: strings.TrimSuffix(*vaultAddr, "/") + "/v1/" +
+			strings.Trim(*vaultMount, "/") + "/data/" + strings.Trim(*vaultPath, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *vaultSecretStore) do(method string, body interface{}, result interface{}) (status int, err error) {
+	var reqBody *bytes.Reader
+	if body == nil {
+		reqBody = bytes.NewReader(nil)
+	} else {
+		ba, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(ba)
+	}
+
+	req, err := http.NewRequest(method, s.url, reqBody)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("X-Vault-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	status = resp.StatusCode
+
+	ba, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	if status == http.StatusNotFound {
+		return
+	}
+
+	if status/100 != 2 {
+		vaultErr := struct{ Errors []string }{}
+		json.Unmarshal(ba, &vaultErr)
+
+		if status == http.StatusBadRequest {
+			for _, e := range vaultErr.Errors {
+				if strings.Contains(e, "check-and-set") {
+					return status, errVaultCASMismatch
+				}
+			}
+		}
+
+		return status, fmt.Errorf("vault: %s %s: %s %s", method, s.url, resp.Status, strings.Join(vaultErr.Errors, ", "))
+	}
+
+	if result != nil {
+		err = json.Unmarshal(ba, result)
+	}
+	return
+}
+
+// get returns the stored data and its version (0 when there's none).
+func (s *vaultSecretStore) get() (ba []byte, version int, err error) {
+	result := struct {
+		Data struct {
+			Data     *vaultSecret
+			Metadata struct {
+				Version int
+			}
+		}
+	}{}
+
+	status, err := s.do(http.MethodGet, nil, &result)
+	if err != nil || status == http.StatusNotFound {
+		return
+	}
+
+	version = result.Data.Metadata.Version
+
+	// a deleted secret version has no data
+	if result.Data.Data != nil && result.Data.Data.SecretData != "" {
+		ba = []byte(result.Data.Data.SecretData)
+	}
+	return
+}
+
+// put stores the data; the current version must be cas if it's not nil.
+func (s *vaultSecretStore) put(ba []byte, cas *int) (err error) {
+	body := struct {
+		Options map[string]interface{} `json:"options,omitempty"`
+		Data    vaultSecret            `json:"data"`
+	}{
+		Data: vaultSecret{string(ba)},
+	}
+
+	if cas != nil {
+		body.Options = map[string]interface{}{"cas": *cas}
+	}
+
+	_, err = s.do(http.MethodPost, body, nil)
+	return
+}
+
+func (s *vaultSecretStore) Load() (ba []byte, err error) {
+	ba, _, err = s.get()
+	return
+}
+
+func (s *vaultSecretStore) Save(ba []byte) error {
+	return s.put(ba, nil)
+}
+
+func (s *vaultSecretStore) Update(update func(current []byte) ([]byte, error)) (err error) {
+	for try := 0; try < 10; try++ {
+		current, version, err := s.get()
+		if err != nil {
+			return err
+		}
+
+		ba, err := update(current)
+		if err != nil {
+			return err
+		}
+
+		err = s.put(ba, &version)
+		if err != errVaultCASMismatch {
+			return err
+		}
+
+		log.Info("vault: secret data changed concurrently, retrying the update")
+	}
+
+	return errVaultCASMismatch
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault is a minimal Vault KV v2 stand-in, for a single secret.
+type fakeVault struct {
+	l        sync.Mutex
+	versions []string
+	puts     int
+
+	// beforePut is called before each write is applied (ie: to simulate a concurrent write)
+	beforePut func(v *fakeVault)
+}
+
+func (v *fakeVault) write(data string) {
+	v.versions = append(v.versions, data)
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "test-token" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+
+	if r.URL.Path != "/v1/secret/data/direktil/secret-data" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+
+	v.l.Lock()
+	defer v.l.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if len(v.versions) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+
+		resp := map[string]interface{}{}
+		resp["data"] = map[string]interface{}{
+			"data":     map[string]string{"secret_data": v.versions[len(v.versions)-1]},
+			"metadata": map[string]interface{}{"version": len(v.versions)},
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodPost:
+		req := struct {
+			Options struct{ CAS *int }
+			Data    vaultSecret
+		}{}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		v.puts++
+		if v.beforePut != nil {
+			v.beforePut(v)
+		}
+
+		if req.Options.CAS != nil && *req.Options.CAS != len(v.versions) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+
+		v.write(req.Data.SecretData)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": len(v.versions)}})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestVaultStore(t *testing.T, vault *fakeVault) (store *vaultSecretStore, stop func()) {
+	srv := httptest.NewServer(vault)
+
+	dir, err := ioutil.TempDir("", "dkl-local-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevAddr, prevMount, prevPath, prevTokenFile := *vaultAddr, *vaultMount, *vaultPath, *vaultTokenFile
+	stop = func() {
+		*vaultAddr, *vaultMount, *vaultPath, *vaultTokenFile = prevAddr, prevMount, prevPath, prevTokenFile
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+
+	*vaultAddr, *vaultMount, *vaultPath, *vaultTokenFile = srv.URL+"/", "secret", "/direktil/secret-data", tokenFile
+
+	store, err = newVaultSecretStore()
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+
+	store.client.Timeout = 5 * time.Second
+	return
+}
+
+func TestVaultSecretStore(t *testing.T) {
+	vault := &fakeVault{}
+
+	store, stop := newTestVaultStore(t, vault)
+	defer stop()
+
+	// 404: no data yet
+	ba, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ba != nil {
+		t.Errorf("expected no data, got %q", ba)
+	}
+
+	if err = store.Save([]byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ba, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ba) != "v1" {
+		t.Errorf("expected v1, got %q", ba)
+	}
+
+	// update
+	err = store.Update(func(current []byte) ([]byte, error) {
+		if string(current) != "v1" {
+			t.Errorf("update: expected v1, got %q", current)
+		}
+		return []byte("v2"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vault.versions) != 2 || vault.versions[1] != "v2" {
+		t.Errorf("unexpected versions: %q", vault.versions)
+	}
+}
+
+func TestVaultSecretStoreUpdateRetry(t *testing.T) {
+	vault := &fakeVault{}
+	vault.write("v1")
+
+	// another server writes just before our first write
+	vault.beforePut = func(v *fakeVault) {
+		if v.puts == 1 {
+			v.write("other")
+		}
+	}
+
+	store, stop := newTestVaultStore(t, vault)
+	defer stop()
+
+	seen := make([]string, 0)
+
+	err := store.Update(func(current []byte) ([]byte, error) {
+		seen = append(seen, string(current))
+		return append(current, "+mine"...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != 2 || seen[0] != "v1" || seen[1] != "other" {
+		t.Errorf("update not retried on the concurrent version: %q", seen)
+	}
+
+	if last := vault.versions[len(vault.versions)-1]; last != "other+mine" {
+		t.Errorf("concurrent write lost: %q", last)
+	}
+}
+
+func TestVaultSecretStoreUpdateGivesUp(t *testing.T) {
+	vault := &fakeVault{}
+
+	// always a concurrent write
+	vault.beforePut = func(v *fakeVault) { v.write("other") }
+
+	store, stop := newTestVaultStore(t, vault)
+	defer stop()
+
+	err := store.Update(func(current []byte) ([]byte, error) {
+		return []byte("mine"), nil
+	})
+	if err != errVaultCASMismatch {
+		t.Errorf("expected %v, got %v", errVaultCASMismatch, err)
+	}
+}
+
+func TestVaultSecretStoreErrors(t *testing.T) {
+	vault := &fakeVault{}
+
+	store, stop := newTestVaultStore(t, vault)
+	defer stop()
+
+	store.token = "wrong"
+
+	if _, err := store.Load(); err == nil {
+		t.Error("error not reported")
+	}
+	if err := store.Save([]byte("x")); err == nil {
+		t.Error("error not reported")
+	}
+}
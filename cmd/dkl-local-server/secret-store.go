@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+var (
+	secretStoreKind       = flag.String("secret-store", "file", "Secret data storage: file (in the data dir) or vault (KV v2, shareable between servers)")
+	secretRefreshInterval = flag.Duration("secret-refresh-interval", time.Minute, "Time between reloads of the secret data from the store, following the changes of the other servers sharing it (0 disables, unused with the file store)")
+
+	secretStorage secretStore
+)
+
+// secretStore stores the secret data (encrypted by the caller when a key is given).
+type secretStore interface {
+	// Load returns the stored data, or nil if there's none yet.
+	Load() (ba []byte, err error)
+	// Save replaces the stored data.
+	Save(ba []byte) error
+	// Update atomically replaces the stored data by the result of update,
+	// called with the current data (nil if there's none yet).
+	Update(update func(current []byte) ([]byte, error)) error
+}
+
+func setupSecretStore() (err error) {
+	switch *secretStoreKind {
+	case "file":
+		secretStorage = &fileSecretStore{path: secretDataPath()}
+
+	case "vault":
+		secretStorage, err = newVaultSecretStore()
+
+	default:
+		err = fmt.Errorf("invalid secret store: %q", *secretStoreKind)
+	}
+
+	return
+}
+
+// secretDataRefresher periodically merges the stored secret data in the local one.
+func secretDataRefresher() {
+	if *secretRefreshInterval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(*secretRefreshInterval)
+
+		sd := secretData
+		if sd == nil {
+			// not loaded yet
+			continue
+		}
+
+		if err := sd.Refresh(); err != nil {
+			log.Error("failed to refresh the secret data: ", err)
+		}
+	}
+}
+
+// fileSecretStore is a secretStore in a local file.
+type fileSecretStore struct {
+	l    sync.Mutex
+	path string
+}
+
+var _ secretStore = &fileSecretStore{}
+
+func (s *fileSecretStore) Load() (ba []byte, err error) {
+	ba, err = ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return
+}
+
+func (s *fileSecretStore) Save(ba []byte) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.write(ba)
+}
+
+func (s *fileSecretStore) Update(update func(current []byte) ([]byte, error)) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	current, err := s.Load()
+	if err != nil {
+		return err
+	}
+
+	ba, err := update(current)
+	if err != nil {
+		return err
+	}
+
+	return s.write(ba)
+}
+
+func (s *fileSecretStore) write(ba []byte) (err error) {
+	out, err := ioutil.TempFile(filepath.Dir(s.path), ".secret-data")
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(out.Name())
+
+	_, err = out.Write(ba)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+
+	return os.Rename(out.Name(), s.path)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+const (
+	secretKeyEnv = "DKL_SECRET_KEY"
+
+	secretDataEncryption = "AES-256-GCM"
+)
+
+var (
+	secretKeyFile = flag.String("secret-key-file", "",
+		"File containing the base64 encoded 32 bytes key encrypting the secret data (defaults to the "+secretKeyEnv+" environment variable; no key means no encryption)")
+	rekeySecretDataTo = flag.String("rekey-secret-data", "",
+		"Re-encrypt the secret data with the key in the given file, then exit (the server must be stopped, as every server sharing the secret store)")
+
+	// secretKey is the secret data's key, nil if not encrypted
+	secretKey []byte
+
+	// secretDataAD binds the ciphertext to its use
+	secretDataAD = []byte("dkl-local-server secret-data")
+)
+
+// encryptedSecretData is the stored form of the secret data when encrypted.
+type encryptedSecretData struct {
+	Encryption string
+	// KeyID identifies the key (hash prefix), to report key mismatches clearly
+	KeyID string
+	Nonce []byte
+	Data  []byte
+}
+
+func loadSecretKey() (err error) {
+	var encoded string
+
+	switch {
+	case *secretKeyFile != "":
+		ba, err := ioutil.ReadFile(*secretKeyFile)
+		if err != nil {
+			return err
+		}
+		encoded = string(ba)
+
+	case os.Getenv(secretKeyEnv) != "":
+		encoded = os.Getenv(secretKeyEnv)
+
+	default:
+		log.Warning("no secret data key given, secret data will be stored in clear")
+		return
+	}
+
+	secretKey, err = parseSecretKey(encoded)
+	return
+}
+
+func parseSecretKey(encoded string) (key []byte, err error) {
+	key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %v", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid secret key: need 32 bytes, got %d", len(key))
+	}
+
+	return
+}
+
+func secretKeyID(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:4])
+}
+
+func secretDataAEAD(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealSecretData(plain, key []byte) (ba []byte, err error) {
+	aead, err := secretDataAEAD(key)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	return json.Marshal(encryptedSecretData{
+		Encryption: secretDataEncryption,
+		KeyID:      secretKeyID(key),
+		Nonce:      nonce,
+		Data:       aead.Seal(nil, nonce, plain, secretDataAD),
+	})
+}
+
+// openSecretData returns the clear form of the stored secret data.
+func openSecretData(ba []byte, key []byte) (plain []byte, encrypted bool, err error) {
+	raw := map[string]json.RawMessage{}
+	if err = json.Unmarshal(ba, &raw); err != nil {
+		return
+	}
+
+	if _, ok := raw["Encryption"]; !ok {
+		return ba, false, nil
+	}
+
+	encrypted = true
+
+	enc := encryptedSecretData{}
+	if err = json.Unmarshal(ba, &enc); err != nil {
+		return
+	}
+
+	if enc.Encryption != secretDataEncryption {
+		err = fmt.Errorf("unsupported secret data encryption: %q", enc.Encryption)
+		return
+	}
+
+	if key == nil {
+		err = errors.New("secret data is encrypted but no key was given")
+		return
+	}
+
+	if id := secretKeyID(key); id != enc.KeyID {
+		err = fmt.Errorf("secret data is encrypted with key %s, not with the given key (%s)", enc.KeyID, id)
+		return
+	}
+
+	aead, err := secretDataAEAD(key)
+	if err != nil {
+		return
+	}
+
+	plain, err = aead.Open(nil, enc.Nonce, enc.Data, secretDataAD)
+	if err != nil {
+		err = fmt.Errorf("failed to decrypt secret data: %v", err)
+	}
+	return
+}
+
+// readStoredSecretData reads the stored secret data; it returns nil if there's none yet.
+func readStoredSecretData(key []byte) (data *secretDataFile, encrypted bool, err error) {
+	ba, err := secretStorage.Load()
+	if err != nil || ba == nil {
+		return
+	}
+
+	plain, encrypted, err := openSecretData(ba, key)
+	if err != nil {
+		return
+	}
+
+	data, err = decodeSecretData(plain)
+	return
+}
+
+// encodeSecretData returns the stored form of the secret data, encrypted if a key is given.
+func encodeSecretData(plain, key []byte) (ba []byte, err error) {
+	if key == nil {
+		return plain, nil
+	}
+
+	return sealSecretData(plain, key)
+}
+
+// rekeySecretData re-encrypts the stored secret data with the key in the given file.
+func rekeySecretData(newKeyFile string) (err error) {
+	ba, err := ioutil.ReadFile(newKeyFile)
+	if err != nil {
+		return
+	}
+
+	newKey, err := parseSecretKey(string(ba))
+	if err != nil {
+		return
+	}
+
+	data, _, err := readStoredSecretData(secretKey)
+	if err != nil {
+		return
+	}
+
+	if data == nil {
+		return errors.New("no secret data to re-key")
+	}
+
+	data.Version = secretDataVersion
+
+	plain, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	ba, err = encodeSecretData(plain, newKey)
+	if err != nil {
+		return
+	}
+
+	if err = secretStorage.Save(ba); err != nil {
+		return
+	}
+
+	log.Infof("secret data re-keyed with key %s", secretKeyID(newKey))
+	return
+}
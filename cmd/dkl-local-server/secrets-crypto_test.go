@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSecretKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// withSecretStore uses a file store in a temporary data dir with the given key,
+// returning a function restoring the previous setup.
+func withSecretStore(t *testing.T, key []byte) (restore func()) {
+	restoreDataDir := withDataDir(t)
+
+	prevKey, prevStorage, prevData, prevSSL := secretKey, secretStorage, secretData, prevSSLConfig
+
+	secretKey = key
+	secretStorage = &fileSecretStore{path: secretDataPath()}
+
+	return func() {
+		secretKey, secretStorage, secretData, prevSSLConfig = prevKey, prevStorage, prevData, prevSSL
+		restoreDataDir()
+	}
+}
+
+func TestSealOpenSecretData(t *testing.T) {
+	key := newTestSecretKey(t)
+	plain := []byte(`{"Version":2}`)
+
+	sealed, err := sealSecretData(plain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(sealed, plain) {
+		t.Error("sealed data contains the plain data")
+	}
+
+	opened, encrypted, err := openSecretData(sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted || !bytes.Equal(opened, plain) {
+		t.Errorf("unexpected result: %v %q", encrypted, opened)
+	}
+
+	// a different key is reported as such
+	if _, _, err := openSecretData(sealed, newTestSecretKey(t)); err == nil {
+		t.Error("opened with the wrong key")
+	}
+
+	if _, _, err := openSecretData(sealed, nil); err == nil {
+		t.Error("opened without key")
+	}
+
+	// tampered data
+	enc := encryptedSecretData{}
+	json.Unmarshal(sealed, &enc)
+	enc.Data[0] ^= 1
+	tampered, _ := json.Marshal(enc)
+
+	if _, _, err := openSecretData(tampered, key); err == nil {
+		t.Error("opened tampered data")
+	}
+
+	// unknown encryption
+	enc.Encryption = "ROT13"
+	unknown, _ := json.Marshal(enc)
+
+	if _, _, err := openSecretData(unknown, key); err == nil {
+		t.Error("opened an unknown encryption")
+	}
+}
+
+func TestOpenPlainSecretData(t *testing.T) {
+	plain := []byte(`{"Version":2,"Clusters":{}}`)
+
+	for _, key := range [][]byte{nil, newTestSecretKey(t)} {
+		opened, encrypted, err := openSecretData(plain, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted || !bytes.Equal(opened, plain) {
+			t.Errorf("unexpected result: %v %q", encrypted, opened)
+		}
+	}
+
+	if _, _, err := openSecretData([]byte("not json"), nil); err == nil {
+		t.Error("invalid data accepted")
+	}
+}
+
+func TestDecodeSecretData(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		clusters int
+		hosts    int
+		token    string
+	}{
+		{
+			name:     "v1 (clusters only)",
+			data:     `{"c1":{"Tokens":{"t1":"abc"}}}`,
+			clusters: 1,
+			token:    "abc",
+		},
+		{
+			name:     "v2",
+			data:     `{"Version":2,"Clusters":{"c1":{"Tokens":{"t1":"abc"}}},"Hosts":{"h1":{"Token":"def"}}}`,
+			clusters: 1,
+			hosts:    1,
+			token:    "abc",
+		},
+		{
+			name: "v2 empty",
+			data: `{"Version":2}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := decodeSecretData([]byte(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if data.Clusters == nil || data.Hosts == nil {
+				t.Fatal("nil maps")
+			}
+			if len(data.Clusters) != tc.clusters || len(data.Hosts) != tc.hosts {
+				t.Errorf("expected %d clusters and %d hosts, got %d and %d",
+					tc.clusters, tc.hosts, len(data.Clusters), len(data.Hosts))
+			}
+			if tc.token != "" && data.Clusters["c1"].Tokens["t1"] != tc.token {
+				t.Errorf("token not decoded")
+			}
+		})
+	}
+}
+
+func TestParseSecretKey(t *testing.T) {
+	key := newTestSecretKey(t)
+
+	parsed, err := parseSecretKey(base64.StdEncoding.EncodeToString(key) + "\n")
+	if err != nil || !bytes.Equal(parsed, key) {
+		t.Errorf("unexpected result: %v", err)
+	}
+
+	for _, invalid := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(key[:16])} {
+		if _, err := parseSecretKey(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestSecretDataMigration(t *testing.T) {
+	key := newTestSecretKey(t)
+	defer withSecretStore(t, key)()
+
+	// v1 data, in clear
+	v1 := []byte(`{"c1":{"CAs":{},"Tokens":{"t1":"abc"},"Passwords":{}}}`)
+	if err := ioutil.WriteFile(secretDataPath(), v1, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadSecretData(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ioutil.ReadFile(secretDataPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stored, []byte("abc")) {
+		t.Fatal("secret data still in clear after load")
+	}
+
+	data, encrypted, err := readStoredSecretData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted {
+		t.Error("not encrypted")
+	}
+	if data.Version != secretDataVersion {
+		t.Errorf("not migrated to version %d: %d", secretDataVersion, data.Version)
+	}
+	if data.Clusters["c1"].Tokens["t1"] != "abc" {
+		t.Error("token lost")
+	}
+}
+
+func TestRekeySecretData(t *testing.T) {
+	oldKey, newKey := newTestSecretKey(t), newTestSecretKey(t)
+	defer withSecretStore(t, oldKey)()
+
+	plain := []byte(`{"Version":2,"Clusters":{"c1":{"Tokens":{"t1":"abc"}}}}`)
+	ba, err := encodeSecretData(plain, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = secretStorage.Save(ba); err != nil {
+		t.Fatal(err)
+	}
+
+	newKeyFile := filepath.Join(*dataDir, "new.key")
+	ioutil.WriteFile(newKeyFile, []byte(base64.StdEncoding.EncodeToString(newKey)), 0600)
+
+	if err = rekeySecretData(newKeyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = readStoredSecretData(oldKey); err == nil {
+		t.Error("still readable with the old key")
+	}
+
+	data, _, err := readStoredSecretData(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Clusters["c1"].Tokens["t1"] != "abc" {
+		t.Error("token lost")
+	}
+}
+
+func TestLockDataDir(t *testing.T) {
+	defer withDataDir(t)()
+
+	if err := lockDataDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	held := dataDirLock
+	defer func() {
+		held.Close()
+		dataDirLock = nil
+	}()
+
+	// another user of the data dir (ie: -rekey-secret-data while the server runs)
+	if err := lockDataDir(); err != errDataDirLocked {
+		t.Errorf("expected %v, got %v", errDataDirLocked, err)
+	}
+
+	held.Close()
+
+	if err := lockDataDir(); err != nil {
+		t.Errorf("lock not released: %v", err)
+	}
+	held = dataDirLock
+}
@@ -1,22 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/big"
 	"net"
-	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudflare/cfssl/config"
 	"github.com/cloudflare/cfssl/csr"
 	"github.com/cloudflare/cfssl/helpers"
-	"github.com/cloudflare/cfssl/initca"
 	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/cfssl/signer"
 	"github.com/cloudflare/cfssl/signer/local"
@@ -32,27 +34,62 @@ type SecretData struct {
 	l sync.Mutex
 
 	clusters map[string]*ClusterSecrets
+	hosts    map[string]*HostSecrets
 	changed  bool
 	config   *config.Config
+
+	// dirty are the entries changed since the last save, kept over the stored ones
+	dirty map[string]bool
+	// deleted are the entries deleted since the last save, not to merge back from the store
+	deleted map[string]bool
+
+	// dryRun is set on copies that must never be saved
+	dryRun bool
 }
 
+// secretDataFile is the stored form of the secret data.
+// The first format was the clusters map only, it is still read.
+type secretDataFile struct {
+	Version  int
+	Clusters map[string]*ClusterSecrets
+	Hosts    map[string]*HostSecrets
+}
+
+const secretDataVersion = 2
+
 type ClusterSecrets struct {
 	CAs       map[string]*CA
 	Tokens    map[string]string
 	Passwords map[string]string
 }
 
+type HostSecrets struct {
+	Token string
+}
+
 type CA struct {
 	Key  []byte
 	Cert []byte
 
+	// Chain is the chain of an imported CA's certificate
+	Chain    []byte `json:",omitempty"`
+	Imported bool   `json:",omitempty"`
+
 	Signed map[string]*KeyCert
+
+	// Rotation is the CA's rotation in progress, if any
+	Rotation *CARotation `json:",omitempty"`
 }
 
 type KeyCert struct {
 	Key     []byte
 	Cert    []byte
 	ReqHash string
+	Profile string `json:",omitempty"`
+	Label   string `json:",omitempty"`
+
+	NotBefore time.Time
+	NotAfter  time.Time
 }
 
 func secretDataPath() string {
@@ -64,26 +101,85 @@ func loadSecretData(config *config.Config) (err error) {
 
 	sd := &SecretData{
 		clusters: make(map[string]*ClusterSecrets),
+		hosts:    make(map[string]*HostSecrets),
 		changed:  false,
 		config:   config,
 	}
 
-	ba, err := ioutil.ReadFile(secretDataPath())
+	data, encrypted, err := readStoredSecretData(secretKey)
 	if err != nil {
-		if os.IsNotExist(err) {
-			sd.changed = true
-			err = nil
-			secretData = sd
-			return
-		}
 		return
 	}
 
-	if err = json.Unmarshal(ba, &sd.clusters); err != nil {
+	if data == nil {
+		sd.changed = true
+		secretData = sd
 		return
 	}
 
+	sd.clusters = data.Clusters
+	sd.hosts = data.Hosts
+
 	secretData = sd
+	updateHostsCAPool(sd)
+
+	if !encrypted && secretKey != nil {
+		log.Info("Encrypting secret data")
+		err = sd.Save()
+	}
+
+	return
+}
+
+// dryRunSecretData returns a copy of the stored secret data, signing with the given config.
+// It's used to render candidate configs: what it creates or changes is never saved.
+func dryRunSecretData(config *config.Config) (sd *SecretData, err error) {
+	data, _, err := readStoredSecretData(secretKey)
+	if err != nil {
+		return
+	}
+
+	sd = &SecretData{
+		clusters: make(map[string]*ClusterSecrets),
+		hosts:    make(map[string]*HostSecrets),
+		config:   config,
+		dryRun:   true,
+	}
+
+	if data != nil {
+		sd.clusters = data.Clusters
+		sd.hosts = data.Hosts
+	}
+
+	return
+}
+
+func decodeSecretData(ba []byte) (data *secretDataFile, err error) {
+	raw := map[string]json.RawMessage{}
+	if err = json.Unmarshal(ba, &raw); err != nil {
+		return
+	}
+
+	data = &secretDataFile{}
+
+	if _, ok := raw["Version"]; ok {
+		err = json.Unmarshal(ba, data)
+	} else {
+		// first format: clusters only
+		err = json.Unmarshal(ba, &data.Clusters)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if data.Clusters == nil {
+		data.Clusters = make(map[string]*ClusterSecrets)
+	}
+	if data.Hosts == nil {
+		data.Hosts = make(map[string]*HostSecrets)
+	}
+
 	return
 }
 
@@ -92,15 +188,214 @@ func (sd *SecretData) Changed() bool {
 }
 
 func (sd *SecretData) Save() error {
+	if sd.dryRun {
+		return errors.New("dry-run secret data can't be saved")
+	}
+
+	err := sd.save()
+
+	if err == nil {
+		updateHostsCAPool(sd)
+	}
+
+	secretDataSavesMetric.WithLabelValues(resultLabel(err)).Inc()
+	return err
+}
+
+func (sd *SecretData) save() error {
 	sd.l.Lock()
 	defer sd.l.Unlock()
 
 	log.Info("Saving secret data")
-	ba, err := json.Marshal(sd.clusters)
+	err := secretStorage.Update(func(current []byte) ([]byte, error) {
+		if current != nil {
+			plain, _, err := openSecretData(current, secretKey)
+			if err != nil {
+				return nil, err
+			}
+
+			stored, err := decodeSecretData(plain)
+			if err != nil {
+				return nil, err
+			}
+
+			sd.mergeStored(stored)
+		}
+
+		ba, err := json.Marshal(secretDataFile{
+			Version:  secretDataVersion,
+			Clusters: sd.clusters,
+			Hosts:    sd.hosts,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeSecretData(ba, secretKey)
+	})
+
+	if err == nil {
+		sd.changed = false
+		sd.dirty = nil
+		sd.deleted = nil
+	}
+
+	return err
+}
+
+// Refresh merges the stored data, that may have been changed by another
+// server sharing the store, in the local data.
+func (sd *SecretData) Refresh() (err error) {
+	ba, err := secretStorage.Load()
+	if err != nil || ba == nil {
+		return
+	}
+
+	plain, _, err := openSecretData(ba, secretKey)
 	if err != nil {
-		return err
+		return
+	}
+
+	stored, err := decodeSecretData(plain)
+	if err != nil {
+		return
 	}
-	return ioutil.WriteFile(secretDataPath(), ba, 0600)
+
+	sd.l.Lock()
+	sd.mergeStored(stored)
+	sd.l.Unlock()
+
+	updateHostsCAPool(sd)
+	return
+}
+
+// mergeStored merges the stored data (ie: changed by another server sharing the store)
+// in the local data. The entries changed locally since the last save are kept, every
+// other entry is taken from the store. The merged CAs are new values replacing the local
+// ones, as the CAs are used without the lock once obtained. sd.l must be held.
+func (sd *SecretData) mergeStored(stored *secretDataFile) {
+	for name, storedCS := range stored.Clusters {
+		cs, ok := sd.clusters[name]
+		if !ok {
+			sd.clusters[name] = storedCS
+			continue
+		}
+
+		if cs.CAs == nil {
+			cs.CAs = make(map[string]*CA)
+		}
+
+		for caName, storedCA := range storedCS.CAs {
+			ca, ok := cs.CAs[caName]
+			if !ok {
+				cs.CAs[caName] = storedCA
+				continue
+			}
+
+			cs.CAs[caName] = sd.mergeStoredCA(name, caName, ca, storedCA)
+		}
+
+		cs.Tokens = sd.mergeStoredStrings(cs.Tokens, storedCS.Tokens, "token", name)
+		cs.Passwords = sd.mergeStoredStrings(cs.Passwords, storedCS.Passwords, "password", name)
+	}
+
+	for name, hs := range stored.Hosts {
+		if !sd.isDirty("host", name) {
+			sd.hosts[name] = hs
+		}
+	}
+}
+
+// mergeStoredCA returns the merge of the local and stored CA, as a new value.
+func (sd *SecretData) mergeStoredCA(cluster, name string, ca, stored *CA) *CA {
+	caDirty := sd.isDirty("ca", cluster, name)
+
+	base := stored
+	if caDirty {
+		base = ca
+	}
+
+	signed := make(map[string]*KeyCert)
+	for kcName, kc := range base.Signed {
+		signed[kcName] = kc
+	}
+
+	// certificates of the same CA can be merged
+	if bytes.Equal(ca.Cert, stored.Cert) {
+		for kcName, kc := range stored.Signed {
+			if !sd.isDirty("cert", cluster, name, kcName) {
+				signed[kcName] = kc
+			}
+		}
+
+		for kcName, kc := range ca.Signed {
+			if _, ok := signed[kcName]; !ok || sd.isDirty("cert", cluster, name, kcName) {
+				signed[kcName] = kc
+			}
+		}
+	}
+
+	merged := *base
+	merged.Signed = signed
+
+	return &merged
+}
+
+// mergeStoredStrings returns the stored values, with the local changes applied.
+func (sd *SecretData) mergeStoredStrings(local, stored map[string]string, kind, cluster string) map[string]string {
+	merged := make(map[string]string, len(stored))
+
+	for k, v := range stored {
+		if !sd.isDeleted(kind, cluster, k) {
+			merged[k] = v
+		}
+	}
+
+	for k, v := range local {
+		if sd.isDirty(kind, cluster, k) {
+			merged[k] = v
+		}
+	}
+
+	return merged
+}
+
+func secretEntry(kind string, path ...string) string {
+	return kind + ":" + strings.Join(path, "/")
+}
+
+// markChanged records a local change of an entry, to keep it over the stored one on save.
+func (sd *SecretData) markChanged(kind string, path ...string) {
+	entry := secretEntry(kind, path...)
+
+	if sd.dirty == nil {
+		sd.dirty = make(map[string]bool)
+	}
+	sd.dirty[entry] = true
+	delete(sd.deleted, entry)
+
+	sd.changed = true
+}
+
+// markDeleted records a local deletion of an entry, not to merge it back from the store on save.
+func (sd *SecretData) markDeleted(kind string, path ...string) {
+	entry := secretEntry(kind, path...)
+
+	if sd.deleted == nil {
+		sd.deleted = make(map[string]bool)
+	}
+	sd.deleted[entry] = true
+	delete(sd.dirty, entry)
+
+	sd.changed = true
+}
+
+func (sd *SecretData) isDirty(kind string, path ...string) bool {
+	return sd.dirty[secretEntry(kind, path...)]
+}
+
+func (sd *SecretData) isDeleted(kind string, path ...string) bool {
+	return sd.deleted[secretEntry(kind, path...)]
 }
 
 func newClusterSecrets() *ClusterSecrets {
@@ -111,15 +406,13 @@ func newClusterSecrets() *ClusterSecrets {
 	}
 }
 
+// cluster returns the cluster's secrets, creating them if needed. sd.l must be held.
 func (sd *SecretData) cluster(name string) (cs *ClusterSecrets) {
 	cs, ok := sd.clusters[name]
 	if ok {
 		return
 	}
 
-	sd.l.Lock()
-	defer sd.l.Unlock()
-
 	log.Info("secret-data: new cluster: ", name)
 
 	cs = newClusterSecrets()
@@ -129,6 +422,9 @@ func (sd *SecretData) cluster(name string) (cs *ClusterSecrets) {
 }
 
 func (sd *SecretData) Passwords(cluster string) (passwords []string) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
 	cs := sd.cluster(cluster)
 
 	passwords = make([]string, 0, len(cs.Passwords))
@@ -142,6 +438,9 @@ func (sd *SecretData) Passwords(cluster string) (passwords []string) {
 }
 
 func (sd *SecretData) Password(cluster, name string) (password string) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
 	cs := sd.cluster(cluster)
 
 	if cs.Passwords == nil {
@@ -153,6 +452,9 @@ func (sd *SecretData) Password(cluster, name string) (password string) {
 }
 
 func (sd *SecretData) SetPassword(cluster, name, password string) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
 	cs := sd.cluster(cluster)
 
 	if cs.Passwords == nil {
@@ -160,10 +462,13 @@ func (sd *SecretData) SetPassword(cluster, name, password string) {
 	}
 
 	cs.Passwords[name] = password
-	sd.changed = true
+	sd.markChanged("password", cluster, name)
 }
 
 func (sd *SecretData) Token(cluster, name string) (token string, err error) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
 	cs := sd.cluster(cluster)
 
 	token = cs.Tokens[name]
@@ -171,11 +476,147 @@ func (sd *SecretData) Token(cluster, name string) (token string, err error) {
 		return
 	}
 
+	log.Info("secret-data: new token in cluster ", cluster, ": ", name)
+
+	token, err = newToken()
+	if err != nil {
+		return
+	}
+
+	cs.Tokens[name] = token
+	sd.markChanged("token", cluster, name)
+	return
+}
+
+// Tokens returns the names of the cluster's tokens.
+func (sd *SecretData) Tokens(cluster string) (tokens []string) {
 	sd.l.Lock()
 	defer sd.l.Unlock()
 
-	log.Info("secret-data: new token in cluster ", cluster, ": ", name)
+	tokens = make([]string, 0)
 
+	cs, ok := sd.clusters[cluster]
+	if !ok {
+		return
+	}
+
+	for name := range cs.Tokens {
+		tokens = append(tokens, name)
+	}
+
+	sort.Strings(tokens)
+
+	return
+}
+
+// FindToken returns the cluster's token, without creating it (nor the cluster).
+func (sd *SecretData) FindToken(cluster, name string) (token string, ok bool) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs, ok := sd.clusters[cluster]
+	if !ok {
+		return
+	}
+
+	token, ok = cs.Tokens[name]
+	return
+}
+
+func (sd *SecretData) SetToken(cluster, name, token string) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs := sd.cluster(cluster)
+
+	if cs.Tokens == nil {
+		cs.Tokens = make(map[string]string)
+	}
+
+	cs.Tokens[name] = token
+	sd.markChanged("token", cluster, name)
+}
+
+// RotateToken replaces the cluster's token with a new one.
+func (sd *SecretData) RotateToken(cluster, name string) (token string, err error) {
+	token, err = newToken()
+	if err != nil {
+		return
+	}
+
+	log.Info("secret-data: rotating token in cluster ", cluster, ": ", name)
+
+	sd.SetToken(cluster, name, token)
+	return
+}
+
+// DeleteToken removes the cluster's token, returning false if it didn't exist.
+func (sd *SecretData) DeleteToken(cluster, name string) bool {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs, ok := sd.clusters[cluster]
+	if !ok {
+		return false
+	}
+
+	if _, ok := cs.Tokens[name]; !ok {
+		return false
+	}
+
+	delete(cs.Tokens, name)
+	sd.markDeleted("token", cluster, name)
+	return true
+}
+
+// DeletePassword removes the cluster's password, returning false if it didn't exist.
+func (sd *SecretData) DeletePassword(cluster, name string) bool {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs, ok := sd.clusters[cluster]
+	if !ok {
+		return false
+	}
+
+	if _, ok := cs.Passwords[name]; !ok {
+		return false
+	}
+
+	delete(cs.Passwords, name)
+	sd.markDeleted("password", cluster, name)
+	return true
+}
+
+// GeneratePassword sets the cluster's password to a random one.
+func (sd *SecretData) GeneratePassword(cluster, name string, length int) (password string, err error) {
+	password, err = newPassword(length)
+	if err != nil {
+		return
+	}
+
+	sd.SetPassword(cluster, name, password)
+	return
+}
+
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func newPassword(length int) (password string, err error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(passwordChars)))
+
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = passwordChars[n.Int64()]
+	}
+
+	return string(b), nil
+}
+
+func newToken() (token string, err error) {
 	b := make([]byte, 16)
 	_, err = rand.Read(b)
 	if err != nil {
@@ -183,13 +624,61 @@ func (sd *SecretData) Token(cluster, name string) (token string, err error) {
 	}
 
 	token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	return
+}
 
-	cs.Tokens[name] = token
-	sd.changed = true
+// HostToken returns the host's own token, creating it if needed.
+func (sd *SecretData) HostToken(host string) (token string, err error) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	if hs, ok := sd.hosts[host]; ok && hs.Token != "" {
+		return hs.Token, nil
+	}
+
+	log.Info("secret-data: new token for host ", host)
+
+	return sd.setNewHostToken(host)
+}
+
+// RotateHostToken replaces the host's token with a new one.
+func (sd *SecretData) RotateHostToken(host string) (token string, err error) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	log.Info("secret-data: rotating token of host ", host)
+
+	return sd.setNewHostToken(host)
+}
+
+func (sd *SecretData) setNewHostToken(host string) (token string, err error) {
+	token, err = newToken()
+	if err != nil {
+		return
+	}
+
+	hs, ok := sd.hosts[host]
+	if !ok {
+		hs = &HostSecrets{}
+		sd.hosts[host] = hs
+	}
+
+	hs.Token = token
+	sd.markChanged("host", host)
 	return
 }
 
+// CA returns the cluster's CA, creating it if needed.
+// The CA must not be modified: changes replace it with a new value.
 func (sd *SecretData) CA(cluster, name string) (ca *CA, err error) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	return sd.ca(cluster, name)
+}
+
+// ca is CA with sd.l held.
+func (sd *SecretData) ca(cluster, name string) (ca *CA, err error) {
 	cs := sd.cluster(cluster)
 
 	ca, ok := cs.CAs[name]
@@ -197,38 +686,74 @@ func (sd *SecretData) CA(cluster, name string) (ca *CA, err error) {
 		return
 	}
 
-	sd.l.Lock()
-	defer sd.l.Unlock()
-
 	log.Info("secret-data: new CA in cluster ", cluster, ": ", name)
 
-	req := &csr.CertificateRequest{
-		CN: "Direktil Local Server",
-		KeyRequest: &csr.BasicKeyRequest{
-			A: "ecdsa",
-			S: 521, // 256, 384, 521
-		},
-		Names: []csr.Name{
-			{
-				C: "NC",
-				O: "novit.nc",
-			},
-		},
-	}
-
-	cert, _, key, err := initca.New(req)
+	ca, err = newCA(cluster, name)
 	if err != nil {
 		return
 	}
 
-	ca = &CA{
-		Key:    key,
-		Cert:   cert,
-		Signed: make(map[string]*KeyCert),
+	cs.CAs[name] = ca
+	sd.markChanged("ca", cluster, name)
+
+	return
+}
+
+// FindCA returns the cluster's CA, or nil if it doesn't exist (it's not created).
+func (sd *SecretData) FindCA(cluster, name string) *CA {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs, ok := sd.clusters[cluster]
+	if !ok {
+		return nil
+	}
+
+	return cs.CAs[name]
+}
+
+// FindCABundle returns the cluster's CA bundle, or nil if the CA doesn't exist (it's not created).
+func (sd *SecretData) FindCABundle(cluster, name string) []byte {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cs, ok := sd.clusters[cluster]
+	if !ok {
+		return nil
+	}
+
+	ca, ok := cs.CAs[name]
+	if !ok {
+		return nil
 	}
 
-	cs.CAs[name] = ca
-	sd.changed = true
+	return ca.Bundle()
+}
+
+// CAs returns the cluster's CAs.
+func (sd *SecretData) CAs(cluster string) (cas map[string]*CA) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	cas = make(map[string]*CA)
+	if cs, ok := sd.clusters[cluster]; ok {
+		for name, ca := range cs.CAs {
+			cas[name] = ca
+		}
+	}
+
+	return
+}
+
+// SignedCerts returns the certificates signed by the CA.
+func (sd *SecretData) SignedCerts(ca *CA) (signed map[string]*KeyCert) {
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	signed = make(map[string]*KeyCert, len(ca.Signed))
+	for name, kc := range ca.Signed {
+		signed[name] = kc
+	}
 
 	return
 }
@@ -260,7 +785,10 @@ func (sd *SecretData) KeyCert(cluster, caName, name, profile, label string, req
 		return
 	}
 
-	ca, err := sd.CA(cluster, caName)
+	sd.l.Lock()
+	defer sd.l.Unlock()
+
+	ca, err := sd.ca(cluster, caName)
 	if err != nil {
 		return
 	}
@@ -268,7 +796,18 @@ func (sd *SecretData) KeyCert(cluster, caName, name, profile, label string, req
 	rh := hash(req)
 	kc, ok := ca.Signed[name]
 	if ok && rh == kc.ReqHash {
-		return
+		if !kc.needsRenewal(time.Now()) {
+			return
+		}
+
+		log.Infof("secret-data: cluster %s: CA %s: renewing %s (expires %s)",
+			cluster, caName, name, kc.NotAfter)
+
+		if !sd.dryRun {
+			atomic.AddInt64(&certRenewals, 1)
+			certRenewalsMetric.Inc()
+		}
+
 	} else if ok {
 		log.Infof("secret-data: cluster %s: CA %s: CSR changed for %s: hash=%q previous=%q",
 			cluster, caName, name, rh, kc.ReqHash)
@@ -276,14 +815,6 @@ func (sd *SecretData) KeyCert(cluster, caName, name, profile, label string, req
 		log.Infof("secret-data: cluster %s: CA %s: new CSR for %s", cluster, caName, name)
 	}
 
-	sd.l.Lock()
-	defer sd.l.Unlock()
-
-	sgr, err := ca.Signer(sd.config.Signing)
-	if err != nil {
-		return
-	}
-
 	generator := &csr.Generator{Validator: func(_ *csr.CertificateRequest) error { return nil }}
 
 	csr, key, err := generator.ProcessRequest(req)
@@ -291,13 +822,7 @@ func (sd *SecretData) KeyCert(cluster, caName, name, profile, label string, req
 		return
 	}
 
-	signReq := signer.SignRequest{
-		Request: string(csr),
-		Profile: profile,
-		Label:   label,
-	}
-
-	cert, err := sgr.Sign(signReq)
+	cert, err := ca.sign(sd.config.Signing, csr, profile, label)
 	if err != nil {
 		return
 	}
@@ -306,10 +831,16 @@ func (sd *SecretData) KeyCert(cluster, caName, name, profile, label string, req
 		Key:     key,
 		Cert:    cert,
 		ReqHash: rh,
+		Profile: profile,
+		Label:   label,
+	}
+
+	if err = kc.loadValidity(); err != nil {
+		return
 	}
 
 	ca.Signed[name] = kc
-	sd.changed = true
+	sd.markChanged("cert", cluster, caName, name)
 
 	return
 }
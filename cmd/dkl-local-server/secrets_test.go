@@ -0,0 +1,340 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestSecretData() *SecretData {
+	return &SecretData{
+		clusters: make(map[string]*ClusterSecrets),
+		hosts:    make(map[string]*HostSecrets),
+	}
+}
+
+func TestMergeStoredStrings(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		local   map[string]string
+		stored  map[string]string
+		dirty   []string
+		deleted []string
+		expect  map[string]string
+	}{
+		{
+			name:   "stored wins when not changed locally",
+			local:  map[string]string{"t1": "local"},
+			stored: map[string]string{"t1": "stored"},
+			expect: map[string]string{"t1": "stored"},
+		},
+		{
+			name:   "local change wins",
+			local:  map[string]string{"t1": "local"},
+			stored: map[string]string{"t1": "stored"},
+			dirty:  []string{"t1"},
+			expect: map[string]string{"t1": "local"},
+		},
+		{
+			name:   "entries added on both sides",
+			local:  map[string]string{"t1": "local"},
+			stored: map[string]string{"t2": "stored"},
+			dirty:  []string{"t1"},
+			expect: map[string]string{"t1": "local", "t2": "stored"},
+		},
+		{
+			name:    "local deletion not merged back",
+			local:   map[string]string{},
+			stored:  map[string]string{"t1": "stored"},
+			deleted: []string{"t1"},
+			expect:  map[string]string{},
+		},
+		{
+			name:   "remote deletion applied",
+			local:  map[string]string{"t1": "local", "t2": "local"},
+			stored: map[string]string{"t2": "stored"},
+			expect: map[string]string{"t2": "stored"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sd := newTestSecretData()
+			for _, k := range tc.dirty {
+				sd.markChanged("token", "c1", k)
+			}
+			for _, k := range tc.deleted {
+				sd.markDeleted("token", "c1", k)
+			}
+
+			merged := sd.mergeStoredStrings(tc.local, tc.stored, "token", "c1")
+
+			if len(merged) != len(tc.expect) {
+				t.Errorf("expected %v, got %v", tc.expect, merged)
+			}
+			for k, v := range tc.expect {
+				if merged[k] != v {
+					t.Errorf("%s: expected %q, got %q", k, v, merged[k])
+				}
+			}
+		})
+	}
+}
+
+func TestMergeStored(t *testing.T) {
+	sd := newTestSecretData()
+
+	localCA := &CA{
+		Cert: []byte("ca1"),
+		Signed: map[string]*KeyCert{
+			"local":  {Cert: []byte("local")},
+			"shared": {Cert: []byte("local shared")},
+		},
+	}
+
+	sd.clusters["c1"] = &ClusterSecrets{
+		CAs:       map[string]*CA{"ca1": localCA},
+		Tokens:    map[string]string{"t1": "local"},
+		Passwords: map[string]string{"p1": "local"},
+	}
+	sd.hosts["h1"] = &HostSecrets{Token: "local"}
+	sd.hosts["h2"] = &HostSecrets{Token: "local"}
+
+	sd.markChanged("token", "c1", "t1")
+	sd.markChanged("host", "h1")
+	sd.markChanged("cert", "c1", "ca1", "local")
+
+	sd.mergeStored(&secretDataFile{
+		Clusters: map[string]*ClusterSecrets{
+			"c1": {
+				CAs: map[string]*CA{
+					"ca1": {
+						Cert: []byte("ca1"),
+						Signed: map[string]*KeyCert{
+							"shared": {Cert: []byte("stored shared")},
+							"remote": {Cert: []byte("remote")},
+						},
+					},
+					"ca2": {Cert: []byte("ca2")},
+				},
+				Tokens:    map[string]string{"t1": "stored", "t2": "stored"},
+				Passwords: map[string]string{"p1": "stored"},
+			},
+			"c2": newClusterSecrets(),
+		},
+		Hosts: map[string]*HostSecrets{
+			"h1": {Token: "stored"},
+			"h2": {Token: "stored"},
+		},
+	})
+
+	cs := sd.clusters["c1"]
+
+	if cs.Tokens["t1"] != "local" || cs.Tokens["t2"] != "stored" {
+		t.Errorf("unexpected tokens: %v", cs.Tokens)
+	}
+	if cs.Passwords["p1"] != "stored" {
+		t.Errorf("unexpected passwords: %v", cs.Passwords)
+	}
+
+	if sd.clusters["c2"] == nil || cs.CAs["ca2"] == nil {
+		t.Error("stored-only entries not merged")
+	}
+
+	if sd.hosts["h1"].Token != "local" || sd.hosts["h2"].Token != "stored" {
+		t.Errorf("unexpected hosts: h1=%q h2=%q", sd.hosts["h1"].Token, sd.hosts["h2"].Token)
+	}
+
+	// the CA may be in use: it's replaced, not modified
+	ca := cs.CAs["ca1"]
+	if ca == localCA {
+		t.Fatal("CA modified in place")
+	}
+	if len(localCA.Signed) != 2 || string(localCA.Signed["shared"].Cert) != "local shared" {
+		t.Errorf("local CA modified: %+v", localCA.Signed)
+	}
+
+	for name, expected := range map[string]string{
+		"local":  "local",
+		"shared": "stored shared",
+		"remote": "remote",
+	} {
+		kc := ca.Signed[name]
+		if kc == nil {
+			t.Errorf("certificate %s missing", name)
+		} else if string(kc.Cert) != expected {
+			t.Errorf("certificate %s: expected %q, got %q", name, expected, kc.Cert)
+		}
+	}
+}
+
+func TestMergeStoredCARotated(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		caDirty  bool
+		expectCA string
+		expect   []string
+	}{
+		// rotated by another server: its CA and certificates are taken
+		{"rotated in the store", false, "new", []string{"stored"}},
+		// rotated locally: the local CA and certificates are kept
+		{"rotated locally", true, "old", []string{"local"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sd := newTestSecretData()
+
+			ca := &CA{
+				Cert:   []byte("old"),
+				Signed: map[string]*KeyCert{"local": {Cert: []byte("local")}},
+			}
+
+			sd.clusters["c1"] = &ClusterSecrets{CAs: map[string]*CA{"ca1": ca}}
+
+			if tc.caDirty {
+				sd.markChanged("ca", "c1", "ca1")
+			}
+
+			ca = sd.mergeStoredCA("c1", "ca1", ca, &CA{
+				Cert:   []byte("new"),
+				Signed: map[string]*KeyCert{"stored": {Cert: []byte("stored")}},
+			})
+
+			if string(ca.Cert) != tc.expectCA {
+				t.Errorf("expected CA %q, got %q", tc.expectCA, ca.Cert)
+			}
+
+			if len(ca.Signed) != len(tc.expect) {
+				t.Errorf("expected certificates %v, got %d", tc.expect, len(ca.Signed))
+			}
+			for _, name := range tc.expect {
+				if ca.Signed[name] == nil {
+					t.Errorf("certificate %s missing", name)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveKeepsConcurrentChanges(t *testing.T) {
+	defer withSecretStore(t, newTestSecretKey(t))()
+
+	// two servers sharing the store
+	a, b := newTestSecretData(), newTestSecretData()
+
+	a.SetToken("c1", "t1", "a")
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.SetToken("c1", "t2", "b")
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Changed() || b.Changed() {
+		t.Error("still changed after save")
+	}
+
+	if err := a.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sd := range []*SecretData{a, b} {
+		tokens := sd.clusters["c1"].Tokens
+		if tokens["t1"] != "a" || tokens["t2"] != "b" {
+			t.Errorf("unexpected tokens: %v", tokens)
+		}
+	}
+
+	stored, _, err := readStoredSecretData(secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := stored.Clusters["c1"].Tokens; tokens["t1"] != "a" || tokens["t2"] != "b" {
+		t.Errorf("unexpected stored tokens: %v", tokens)
+	}
+}
+
+func TestReadOnlyLookups(t *testing.T) {
+	sd := newTestSecretData()
+
+	if _, ok := sd.FindToken("c1", "t1"); ok {
+		t.Error("token found")
+	}
+	if tokens := sd.Tokens("c1"); tokens == nil || len(tokens) != 0 {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+	if sd.DeleteToken("c1", "t1") || sd.DeletePassword("c1", "p1") {
+		t.Error("deleted a missing entry")
+	}
+
+	if len(sd.clusters) != 0 || sd.Changed() {
+		t.Error("lookups changed the secret data")
+	}
+
+	sd.SetToken("c1", "t1", "abc")
+	if token, ok := sd.FindToken("c1", "t1"); !ok || token != "abc" {
+		t.Errorf("unexpected token: %q, %v", token, ok)
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	defer withSecretStore(t, newTestSecretKey(t))()
+
+	// another server sharing the store
+	other := newTestSecretData()
+	other.clusters["c1"] = &ClusterSecrets{
+		CAs:       map[string]*CA{"ca1": {Cert: []byte("ca1"), Signed: map[string]*KeyCert{}}},
+		Tokens:    map[string]string{"t1": "stored"},
+		Passwords: map[string]string{"p1": "stored"},
+	}
+	other.markChanged("ca", "c1", "ca1")
+	if err := other.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	sd := newTestSecretData()
+	if err := sd.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// run with -race: the readers must not race with the refreshes
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	for _, read := range []func(){
+		func() {
+			ca, err := sd.CA("c1", "ca1")
+			if err != nil {
+				t.Error(err)
+			} else if b := string(ca.Bundle()); b != "ca1" {
+				t.Errorf("unexpected bundle: %q", b)
+			}
+		},
+		func() { sd.Password("c1", "p1") },
+		func() { sd.Token("c1", "t1") },
+		func() { sd.SignedCerts(sd.FindCA("c1", "ca1")) },
+	} {
+		read := read
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					read()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := sd.Refresh(); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"io"
 	"math/rand"
+	"sync"
 	"time"
 
 	ulidp "github.com/oklog/ulid"
 )
 
 var (
-	ulidCtx struct{ entropy io.Reader }
+	ulidCtx struct {
+		sync.Mutex
+		entropy io.Reader
+	}
 )
 
 func initUlid() {
@@ -18,5 +22,8 @@ func initUlid() {
 }
 
 func ulid() string {
+	ulidCtx.Lock()
+	defer ulidCtx.Unlock()
+
 	return ulidp.MustNew(ulidp.Now(), ulidCtx.entropy).String()
 }
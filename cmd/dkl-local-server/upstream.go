@@ -37,6 +37,12 @@ func (ctx *renderContext) distFetch(path ...string) (outPath string, err error)
 
 	fullURL := *upstreamURL + "/" + subPath
 
+	start := time.Now()
+	defer func() {
+		distFetchDurationMetric.WithLabelValues(resultLabel(err)).
+			Observe(time.Since(start).Seconds())
+	}()
+
 	resp, err := http.Get(fullURL)
 	if err != nil {
 		return
@@ -60,7 +66,8 @@ func (ctx *renderContext) distFetch(path ...string) (outPath string, err error)
 
 	done := make(chan error, 1)
 	go func() {
-		_, err = io.Copy(out, resp.Body)
+		n, err := io.Copy(out, resp.Body)
+		distFetchBytesMetric.Add(float64(n))
 		fOut.Close()
 
 		if err != nil {
@@ -90,6 +97,7 @@ wait:
 	if remoteSum := resp.Header.Get("X-Content-SHA1"); remoteSum != "" {
 		log.Printf("fetch of %s: remote SHA1 checksum: %s", subPath, remoteSum)
 		if remoteSum != hexSum {
+			distFetchChecksumFailuresMetric.Inc()
 			err = fmt.Errorf("wrong SHA1 checksum: server=%s local=%s", remoteSum, hexSum)
 			log.Print("fetch of ", subPath, ": ", err)
 			os.Remove(fOut.Name())
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+type auditPage struct {
+	Total   int
+	Offset  int
+	Entries []auditEntry
+}
+
+func wsAudit(req *restful.Request, resp *restful.Response) {
+	offset, err := intQueryParameter(req, "offset", 0)
+	if err != nil {
+		resp.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := intQueryParameter(req, "limit", 100)
+	if err != nil {
+		resp.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, total, err := auditLog.Read(offset, limit)
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	resp.WriteEntity(auditPage{
+		Total:   total,
+		Offset:  offset,
+		Entries: entries,
+	})
+}
+
+func intQueryParameter(req *restful.Request, name string, defaultValue int) (int, error) {
+	s := req.QueryParameter(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err == nil && v < 0 {
+		err = strconv.ErrRange
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	return v, nil
+}
@@ -1,31 +1,186 @@
 package main
 
 import (
+	"crypto/subtle"
+	"flag"
+	"log"
+	"net/http"
 	"strings"
 
 	restful "github.com/emicklei/go-restful"
 )
 
+var hostTokensRequired = flag.Bool("host-tokens-required", false, "Require hosts to use their own token on /me (disables the shared -hosts-token and open access)")
+
 func adminAuth(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	tokenAuth(req, resp, chain, *adminToken)
+	cred := findAdminCredential(getToken(req))
+	if cred == nil {
+		resp.WriteErrorString(401, "401: Not Authorized")
+		return
+	}
+
+	req.SetAttribute("admin", cred)
+	chain.ProcessFilter(req, resp)
 }
 
-func hostsAuth(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	tokenAuth(req, resp, chain, *hostsToken, *adminToken)
+func requestAdmin(req *restful.Request) *adminCredential {
+	cred, _ := req.Attribute("admin").(*adminCredential)
+	return cred
+}
+
+// requireScope is a route filter checking the admin credential has the scope
+// and is allowed on the request's cluster or host.
+func requireScope(scope string) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		cred := requestAdmin(req)
+
+		if cred == nil || !cred.HasScope(scope) {
+			adminForbidden(req, resp, cred, "missing scope "+scope)
+			return
+		}
+
+		if cluster := req.PathParameter("cluster-name"); cluster != "" && !cred.AllowsCluster(cluster) {
+			adminForbidden(req, resp, cred, "cluster "+cluster+" not allowed")
+			return
+		}
+
+		if host := req.PathParameter("host-name"); host != "" {
+			if allowed, err := cred.AllowsHost(host); err != nil {
+				adminForbidden(req, resp, cred, "host "+host+" not allowed: "+err.Error())
+				return
+			} else if !allowed {
+				adminForbidden(req, resp, cred, "host "+host+" not allowed")
+				return
+			}
+		}
+
+		chain.ProcessFilter(req, resp)
+	}
 }
 
-func tokenAuth(req *restful.Request, resp *restful.Response, chain *restful.FilterChain, allowedTokens ...string) {
+// requireGlobalScope is like requireScope for the actions spanning every cluster.
+func requireGlobalScope(scope string) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		cred := requestAdmin(req)
+
+		if cred == nil || !cred.HasScope(scope) {
+			adminForbidden(req, resp, cred, "missing scope "+scope)
+			return
+		}
+
+		if cred.Restricted() {
+			adminForbidden(req, resp, cred, "restricted to some clusters")
+			return
+		}
+
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+// requireMeScope is a /me route filter applying requireScope's checks
+// to the admin credentials, on the detected host.
+func requireMeScope(scope string) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		cred := requestAdmin(req)
+		if cred == nil {
+			// authenticated as a host
+			chain.ProcessFilter(req, resp)
+			return
+		}
+
+		if !cred.HasScope(scope) {
+			adminForbidden(req, resp, cred, "missing scope "+scope)
+			return
+		}
+
+		if host := detectHost(req); host != "" {
+			if allowed, err := cred.AllowsHost(host); err != nil {
+				adminForbidden(req, resp, cred, "host "+host+" not allowed: "+err.Error())
+				return
+			} else if !allowed {
+				adminForbidden(req, resp, cred, "host "+host+" not allowed")
+				return
+			}
+		}
+
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+func adminForbidden(req *restful.Request, resp *restful.Response, cred *adminCredential, reason string) {
+	name := ""
+	if cred != nil {
+		name = cred.Name
+	}
+
+	log.Printf("denied %s %s to admin %q: %s", req.Request.Method, req.Request.URL.Path, name, reason)
+	resp.WriteErrorString(http.StatusForbidden, "403: Forbidden")
+}
+
+func hostsAuth(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 	token := getToken(req)
 
-	for _, allowedToken := range allowedTokens {
-		if allowedToken == "" || token == allowedToken {
+	// admin credentials can act as any host they're allowed on (see requireMeScope)
+	if token != "" && len(adminCredentials) != 0 {
+		if cred := findAdminCredential(token); cred != nil {
+			req.SetAttribute("admin", cred)
 			chain.ProcessFilter(req, resp)
 			return
 		}
 	}
 
+	if !*hostTokensRequired && (*hostsToken == "" || len(adminCredentials) == 0 || tokenEquals(token, *hostsToken)) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	if hostCertAuth(req) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	if token != "" && hostTokenAuth(req, token) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
 	resp.WriteErrorString(401, "401: Not Authorized")
-	return
+}
+
+// hostTokenAuth checks the token is the detected host's own token.
+func hostTokenAuth(req *restful.Request, token string) bool {
+	cfg, err := readConfig()
+	if err != nil {
+		return false
+	}
+
+	if err = loadSecretDataFor(cfg); err != nil {
+		log.Print("failed to load secret data: ", err)
+		return false
+	}
+
+	hostName := detectHost(req)
+	if hostName == "" {
+		return false
+	}
+
+	hostToken, err := secretData.HostToken(hostName)
+	if err != nil {
+		log.Printf("host %s: failed to get the token: %v", hostName, err)
+		return false
+	}
+
+	if !tokenEquals(token, hostToken) {
+		log.Printf("host %s: invalid token", hostName)
+		return false
+	}
+
+	req.SetAttribute("host-name", hostName)
+	return true
+}
+
+func tokenEquals(token, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
 }
 
 func getToken(req *restful.Request) string {
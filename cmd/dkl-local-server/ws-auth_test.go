@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+func TestHostsAuth(t *testing.T) {
+	defer withSecretStore(t, newTestSecretKey(t))()
+	defer withConfig(t)()
+	defer withTrustedProxies(t, "", "xff")()
+
+	writeTestConfig(t, "hosts: [{name: h1, ips: [10.0.0.1]}, {name: h2, ips: [10.0.0.2]}]\n")
+
+	cfg, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = loadSecretDataFor(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	h1Token, _ := secretData.HostToken("h1")
+	h2Token, _ := secretData.HostToken("h2")
+
+	prevRequired, prevHostsToken, prevCreds := *hostTokensRequired, *hostsToken, adminCredentials
+	defer func() { *hostTokensRequired, *hostsToken, adminCredentials = prevRequired, prevHostsToken, prevCreds }()
+
+	*hostsToken = "shared"
+	adminCredentials = []*adminCredential{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAll}}}
+
+	ws := &restful.WebService{}
+	ws.Route(ws.GET("/me/host").To(func(req *restful.Request, resp *restful.Response) {
+		resp.Write([]byte(detectHost(req)))
+	}).Filter(hostsAuth))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	for _, tc := range []struct {
+		name     string
+		required bool
+		ip       string
+		token    string
+		expect   string // the detected host, or empty if denied
+	}{
+		{"own token", true, "10.0.0.1", h1Token, "h1"},
+		{"other host", true, "10.0.0.2", h2Token, "h2"},
+		{"other host's token", true, "10.0.0.1", h2Token, ""},
+		{"no token", true, "10.0.0.1", "", ""},
+		{"unknown host", true, "10.0.0.3", h1Token, ""},
+		{"shared token when own tokens are required", true, "10.0.0.1", "shared", ""},
+		{"shared token", false, "10.0.0.1", "shared", "h1"},
+		{"own token when not required", false, "10.0.0.2", h2Token, "h2"},
+		{"bad token", false, "10.0.0.1", "bad", ""},
+		{"admin token", true, "10.0.0.1", "admin-token", "h1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*hostTokensRequired = tc.required
+
+			r := httptest.NewRequest(http.MethodGet, "/me/host", nil)
+			r.RemoteAddr = tc.ip + ":1234"
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+
+			rec := httptest.NewRecorder()
+			c.ServeHTTP(rec, r)
+
+			if tc.expect == "" {
+				if rec.Code != http.StatusUnauthorized {
+					t.Errorf("expected a denial, got %d", rec.Code)
+				}
+				return
+			}
+
+			if rec.Code != http.StatusOK || rec.Body.String() != tc.expect {
+				t.Errorf("expected host %q, got %d %q", tc.expect, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	// a rotated token is not accepted anymore
+	*hostTokensRequired = true
+
+	newToken, err := secretData.RotateHostToken("h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, status := range map[string]int{h1Token: http.StatusUnauthorized, newToken: http.StatusOK} {
+		r := httptest.NewRequest(http.MethodGet, "/me/host", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, r)
+
+		if rec.Code != status {
+			t.Errorf("after rotation: expected status %d, got %d", status, rec.Code)
+		}
+	}
+}
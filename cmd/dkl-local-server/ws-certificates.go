@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/cfssl/helpers"
+	restful "github.com/emicklei/go-restful"
+
+	"novit.nc/direktil/local-server/pkg/mime"
+)
+
+func wsCertRenewals(req *restful.Request, resp *restful.Response) {
+	within := 30 * 24 * time.Hour
+
+	if s := req.QueryParameter("within"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			resp.WriteErrorString(http.StatusBadRequest, "invalid within: "+err.Error())
+			return
+		}
+		within = d
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	cred := requestAdmin(req)
+
+	renewals := make([]certRenewal, 0)
+	for _, renewal := range secretData.Renewals(within) {
+		if cred.AllowsCluster(renewal.Cluster) {
+			renewals = append(renewals, renewal)
+		}
+	}
+
+	resp.WriteEntity(renewals)
+}
+
+// certInfo describes a certificate, without its key.
+type certInfo struct {
+	Name               string `json:",omitempty"`
+	Subject            string
+	Issuer             string
+	DNSNames           []string `json:",omitempty"`
+	IPAddresses        []string `json:",omitempty"`
+	EmailAddresses     []string `json:",omitempty"`
+	Serial             string
+	NotBefore          time.Time
+	NotAfter           time.Time
+	IsCA               bool   `json:",omitempty"`
+	Profile            string `json:",omitempty"`
+	Label              string `json:",omitempty"`
+	KeyAlgorithm       string
+	SignatureAlgorithm string
+	Error              string `json:",omitempty"`
+}
+
+// caInfo describes a CA and its signed certificates.
+type caInfo struct {
+	certInfo
+
+	SignedCount int
+	Signed      []certInfo `json:",omitempty"`
+
+	Imported      bool       `json:",omitempty"`
+	Chain         []certInfo `json:",omitempty"`
+	RotationPhase string     `json:",omitempty"`
+}
+
+// caRotationInfo describes a CA rotation.
+type caRotationInfo struct {
+	Phase    string
+	Started  time.Time
+	Updated  time.Time
+	Next     *certInfo `json:",omitempty"`
+	Previous *certInfo `json:",omitempty"`
+}
+
+func newCARotationInfo(name string, ca *CA) (info *caRotationInfo) {
+	r := ca.Rotation
+	if r == nil {
+		return &caRotationInfo{}
+	}
+
+	info = &caRotationInfo{
+		Phase:   r.Phase,
+		Started: r.Started,
+		Updated: r.Updated,
+	}
+
+	if r.Next != nil {
+		next := newCertInfo(name, r.Next.Cert)
+		info.Next = &next
+	}
+	if r.Previous != nil {
+		previous := newCertInfo(name, r.Previous.Cert)
+		info.Previous = &previous
+	}
+
+	return
+}
+
+func newCertInfo(name string, certPEM []byte) (info certInfo) {
+	info.Name = name
+
+	cert, err := helpers.ParseCertificatePEM(certPEM)
+	if err != nil {
+		info.Error = err.Error()
+		return
+	}
+
+	info.Subject = cert.Subject.String()
+	info.Issuer = cert.Issuer.String()
+	info.DNSNames = cert.DNSNames
+	info.EmailAddresses = cert.EmailAddresses
+	info.Serial = cert.SerialNumber.Text(16)
+	info.NotBefore = cert.NotBefore
+	info.NotAfter = cert.NotAfter
+	info.IsCA = cert.IsCA
+	info.KeyAlgorithm = publicKeyAlgorithm(cert)
+	info.SignatureAlgorithm = cert.SignatureAlgorithm.String()
+
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+
+	return
+}
+
+func publicKeyAlgorithm(cert *x509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// wsLoadSecretData ensures the secret data is loaded for the current config.
+func wsLoadSecretData(resp *restful.Response) bool {
+	cfg := wsReadConfig(resp)
+	if cfg == nil {
+		return false
+	}
+
+	if err := loadSecretDataFor(cfg); err != nil {
+		wsError(resp, err)
+		return false
+	}
+
+	return true
+}
+
+// wsReadCA returns the requested CA, or nil if the response was sent.
+func wsReadCA(req *restful.Request, resp *restful.Response) (ca *CA) {
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	ca = secretData.FindCA(req.PathParameter("cluster-name"), req.PathParameter("ca-name"))
+	if ca == nil {
+		wsNotFound(req, resp)
+	}
+
+	return
+}
+
+func wsClusterCAs(req *restful.Request, resp *restful.Response) {
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	cas := secretData.CAs(req.PathParameter("cluster-name"))
+
+	names := make([]string, 0, len(cas))
+	for name := range cas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]caInfo, 0, len(cas))
+	for _, name := range names {
+		ca := cas[name]
+		infos = append(infos, caInfo{
+			certInfo:      newCertInfo(name, ca.Cert),
+			SignedCount:   len(secretData.SignedCerts(ca)),
+			Imported:      ca.Imported,
+			RotationPhase: ca.RotationPhase(),
+		})
+	}
+
+	resp.WriteEntity(infos)
+}
+
+func wsClusterCA(req *restful.Request, resp *restful.Response) {
+	ca := wsReadCA(req, resp)
+	if ca == nil {
+		return
+	}
+
+	signed := secretData.SignedCerts(ca)
+
+	info := caInfo{
+		certInfo:      newCertInfo(req.PathParameter("ca-name"), ca.Cert),
+		SignedCount:   len(signed),
+		Signed:        make([]certInfo, 0, len(signed)),
+		Imported:      ca.Imported,
+		RotationPhase: ca.RotationPhase(),
+	}
+
+	if len(ca.Chain) != 0 {
+		chain, err := helpers.ParseCertificatesPEM(ca.Chain)
+		if err != nil {
+			wsError(resp, err)
+			return
+		}
+
+		for _, cert := range chain {
+			info.Chain = append(info.Chain, newCertInfo("", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+		}
+	}
+
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		kc := signed[name]
+
+		certInfo := newCertInfo(name, kc.Cert)
+		certInfo.Profile = kc.Profile
+		certInfo.Label = kc.Label
+
+		info.Signed = append(info.Signed, certInfo)
+	}
+
+	resp.WriteEntity(info)
+}
+
+func wsClusterCACert(req *restful.Request, resp *restful.Response) {
+	ca := wsReadCA(req, resp)
+	if ca == nil {
+		return
+	}
+
+	resp.Header().Set("Content-Type", mime.PEM)
+	resp.Write(ca.Cert)
+}
+
+func wsClusterCABundle(req *restful.Request, resp *restful.Response) {
+	ca := wsReadCA(req, resp)
+	if ca == nil {
+		return
+	}
+
+	resp.Header().Set("Content-Type", mime.PEM)
+	resp.Write(ca.Bundle())
+}
+
+func wsClusterCARotation(req *restful.Request, resp *restful.Response) {
+	ca := wsReadCA(req, resp)
+	if ca == nil {
+		return
+	}
+
+	resp.WriteEntity(newCARotationInfo(req.PathParameter("ca-name"), ca))
+}
+
+func wsClusterCARotate(req *restful.Request, resp *restful.Response) {
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	cluster := req.PathParameter("cluster-name")
+	name := req.PathParameter("ca-name")
+	action := req.PathParameter("action")
+
+	ca, err := secretData.RotateCA(cluster, name, action)
+	if err == nil && ca != nil {
+		err = secretData.Save()
+	}
+
+	auditRequest(req, auditEntry{
+		Action:  "ca-rotation-" + action,
+		Cluster: cluster,
+		CA:      name,
+	}, err)
+
+	if rerr, ok := err.(caRotationError); ok {
+		resp.WriteErrorString(http.StatusConflict, rerr.Error())
+		return
+	}
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	if ca == nil {
+		wsNotFound(req, resp)
+		return
+	}
+
+	if action == caRotationSwitch || action == caRotationRetire {
+		// renders using the CA changed
+		cleanCASAsync()
+	}
+
+	resp.WriteEntity(newCARotationInfo(name, ca))
+}
+
+// wsReadSignedCert returns the requested signed certificate, or nil if the response was sent.
+func wsReadSignedCert(req *restful.Request, resp *restful.Response) (ca *CA, name string, kc *KeyCert) {
+	ca = wsReadCA(req, resp)
+	if ca == nil {
+		return
+	}
+
+	name = req.PathParameter("cert-name")
+
+	kc = secretData.SignedCerts(ca)[name]
+	if kc == nil {
+		wsNotFound(req, resp)
+	}
+
+	return
+}
+
+func wsClusterSignedCert(req *restful.Request, resp *restful.Response) {
+	_, name, kc := wsReadSignedCert(req, resp)
+	if kc == nil {
+		return
+	}
+
+	info := newCertInfo(name, kc.Cert)
+	info.Profile = kc.Profile
+	info.Label = kc.Label
+
+	resp.WriteEntity(info)
+}
+
+func wsClusterSignedCertChain(req *restful.Request, resp *restful.Response) {
+	ca, _, kc := wsReadSignedCert(req, resp)
+	if kc == nil {
+		return
+	}
+
+	resp.Header().Set("Content-Type", mime.PEM)
+	resp.Write(pemBundle(kc.Cert, ca.Cert, ca.Chain))
+}
+
+func wsClusterImportCA(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	name := req.PathParameter("ca-name")
+
+	imp := &caImport{}
+	if err := req.ReadEntity(imp); err != nil {
+		resp.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ca, err := imp.validate()
+	if err == nil {
+		err = secretData.ImportCA(cluster.Name, name, ca)
+	}
+	if err == nil {
+		err = secretData.Save()
+	}
+
+	auditRequest(req, auditEntry{
+		Action:  "ca-import",
+		Cluster: cluster.Name,
+		CA:      name,
+	}, err)
+
+	if ierr, ok := err.(caImportError); ok {
+		resp.WriteErrorString(http.StatusBadRequest, ierr.Error())
+		return
+	}
+
+	if err == errCAExists {
+		resp.WriteErrorString(http.StatusConflict, err.Error())
+		return
+	}
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	resp.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// withTestCAs loads the secret data with a CA "ca1", issued by a root, and signing a certificate "s1".
+func withTestCAs(t *testing.T) (restore func(), root, ca1, s1 *testCA) {
+	restoreStore := withSecretStore(t, newTestSecretKey(t))
+	restoreConfig := withConfig(t)
+
+	restore = func() {
+		restoreConfig()
+		restoreStore()
+	}
+
+	writeTestConfig(t, "clusters: [{name: c1}]\n")
+
+	cfg, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = loadSecretDataFor(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	root = newTestCA(t, "root", nil)
+	ca1 = newTestCA(t, "ca1", root)
+	s1 = newTestCA(t, "s1", ca1)
+
+	err = secretData.ImportCA("c1", "ca1", &CA{
+		Key:      ca1.keyPEM,
+		Cert:     ca1.certPEM,
+		Chain:    root.certPEM,
+		Imported: true,
+		Signed: map[string]*KeyCert{
+			"s1": {Key: s1.keyPEM, Cert: s1.certPEM, Profile: "server", Label: "l1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestWsCertificates(t *testing.T) {
+	restore, root, ca1, s1 := withTestCAs(t)
+	defer restore()
+
+	ws := (&restful.WebService{}).Produces(restful.MIME_JSON)
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs").To(wsClusterCAs))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}").To(wsClusterCA))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/ca.pem").To(wsClusterCACert))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/signed/{cert-name:*}").To(wsClusterSignedCert))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/chain/{cert-name:*}").To(wsClusterSignedCertChain))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	get := func(path string, status int) []byte {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, rec.Code)
+		}
+		return rec.Body.Bytes()
+	}
+
+	// list
+	infos := []caInfo{}
+	if err := json.Unmarshal(get("/clusters/c1/CAs", http.StatusOK), &infos); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 || infos[0].Name != "ca1" || infos[0].SignedCount != 1 || !infos[0].Imported ||
+		len(infos[0].Signed) != 0 || infos[0].Subject != "CN=ca1" {
+		t.Errorf("unexpected CAs: %+v", infos)
+	}
+
+	if body := get("/clusters/c2/CAs", http.StatusOK); string(body) != "[]" {
+		t.Errorf("unexpected CAs in an empty cluster: %s", body)
+	}
+
+	// detail
+	info := caInfo{}
+	if err := json.Unmarshal(get("/clusters/c1/CAs/ca1", http.StatusOK), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.SignedCount != 1 || len(info.Signed) != 1 || len(info.Chain) != 1 || info.Chain[0].Subject != "CN=root" {
+		t.Errorf("unexpected CA: %+v", info)
+	} else if s := info.Signed[0]; s.Name != "s1" || s.Subject != "CN=s1" || s.Issuer != "CN=ca1" || s.Profile != "server" || s.Label != "l1" {
+		t.Errorf("unexpected signed certificate: %+v", s)
+	}
+
+	if body := get("/clusters/c1/CAs/ca1/ca.pem", http.StatusOK); string(body) != string(ca1.certPEM) {
+		t.Errorf("unexpected CA certificate: %s", body)
+	}
+
+	// signed certificates
+	cert := certInfo{}
+	if err := json.Unmarshal(get("/clusters/c1/CAs/ca1/signed/s1", http.StatusOK), &cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.Name != "s1" || cert.Subject != "CN=s1" || cert.Profile != "server" || cert.Label != "l1" {
+		t.Errorf("unexpected signed certificate: %+v", cert)
+	}
+
+	if body := get("/clusters/c1/CAs/ca1/chain/s1", http.StatusOK); string(body) != string(pemBundle(s1.certPEM, ca1.certPEM, root.certPEM)) {
+		t.Errorf("unexpected chain: %s", body)
+	}
+
+	// not found
+	for _, path := range []string{
+		"/clusters/c1/CAs/ca2",
+		"/clusters/c2/CAs/ca1",
+		"/clusters/c1/CAs/ca2/ca.pem",
+		"/clusters/c1/CAs/ca1/signed/s2",
+		"/clusters/c1/CAs/ca2/signed/s1",
+		"/clusters/c1/CAs/ca1/chain/s2",
+	} {
+		get(path, http.StatusNotFound)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"net/http"
 
 	restful "github.com/emicklei/go-restful"
 	"novit.nc/direktil/pkg/localconfig"
@@ -13,9 +14,13 @@ func wsListClusters(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
-	clusterNames := make([]string, len(cfg.Clusters))
-	for i, cluster := range cfg.Clusters {
-		clusterNames[i] = cluster.Name
+	cred := requestAdmin(req)
+
+	clusterNames := make([]string, 0, len(cfg.Clusters))
+	for _, cluster := range cfg.Clusters {
+		if cred.AllowsCluster(cluster.Name) {
+			clusterNames = append(clusterNames, cluster.Name)
+		}
 	}
 
 	resp.WriteEntity(clusterNames)
@@ -68,6 +73,10 @@ func wsClusterPasswords(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
 	resp.WriteEntity(secretData.Passwords(cluster.Name))
 }
 func wsClusterPassword(req *restful.Request, resp *restful.Response) {
@@ -76,8 +85,18 @@ func wsClusterPassword(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
 	name := req.PathParameter("password-name")
 
+	auditRequest(req, auditEntry{
+		Action:   "password-read",
+		Cluster:  cluster.Name,
+		Password: name,
+	}, nil)
+
 	resp.WriteEntity(secretData.Password(cluster.Name, name))
 }
 func wsClusterSetPassword(req *restful.Request, resp *restful.Response) {
@@ -86,19 +105,258 @@ func wsClusterSetPassword(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
 	name := req.PathParameter("password-name")
 
 	var password string
 	if err := req.ReadEntity(&password); err != nil {
-		wsError(resp, err) // FIXME this is a BadRequest
+		resp.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if password == "" {
+		resp.WriteErrorString(http.StatusBadRequest, "empty password")
 		return
 	}
 
 	secretData.SetPassword(cluster.Name, name, password)
 
-	if err := secretData.Save(); err != nil {
+	err := secretData.Save()
+
+	auditRequest(req, auditEntry{
+		Action:   "password-write",
+		Cluster:  cluster.Name,
+		Password: name,
+	}, err)
+
+	if err != nil {
 		wsError(resp, err)
+		return
+	}
+
+	cleanCASAsync()
+}
+
+func wsClusterDeletePassword(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	name := req.PathParameter("password-name")
+
+	if !secretData.DeletePassword(cluster.Name, name) {
+		wsNotFound(req, resp)
+		return
+	}
+
+	err := secretData.Save()
+
+	auditRequest(req, auditEntry{
+		Action:   "password-delete",
+		Cluster:  cluster.Name,
+		Password: name,
+	}, err)
+
+	if err != nil {
+		wsError(resp, err)
+		return
 	}
+
+	cleanCASAsync()
+}
+
+func wsClusterGeneratePassword(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	name := req.PathParameter("password-name")
+
+	length, err := intQueryParameter(req, "length", 32)
+	if err != nil || length < 8 || length > 1024 {
+		resp.WriteErrorString(http.StatusBadRequest, "invalid length (8 to 1024)")
+		return
+	}
+
+	password, err := secretData.GeneratePassword(cluster.Name, name, length)
+	if err == nil {
+		err = secretData.Save()
+	}
+
+	auditRequest(req, auditEntry{
+		Action:   "password-generate",
+		Cluster:  cluster.Name,
+		Password: name,
+	}, err)
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	cleanCASAsync()
+
+	resp.WriteEntity(password)
+}
+
+func wsClusterTokens(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	resp.WriteEntity(secretData.Tokens(cluster.Name))
+}
+
+func wsClusterToken(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	name := req.PathParameter("token-name")
+
+	token, ok := secretData.FindToken(cluster.Name, name)
+	if !ok {
+		wsNotFound(req, resp)
+		return
+	}
+
+	auditRequest(req, auditEntry{
+		Action:  "token-read",
+		Cluster: cluster.Name,
+		Token:   name,
+	}, nil)
+
+	resp.WriteEntity(token)
+}
+
+func wsClusterSetToken(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	name := req.PathParameter("token-name")
+
+	var token string
+	if err := req.ReadEntity(&token); err != nil {
+		resp.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if token == "" {
+		resp.WriteErrorString(http.StatusBadRequest, "empty token")
+		return
+	}
+
+	secretData.SetToken(cluster.Name, name, token)
+
+	err := secretData.Save()
+
+	auditRequest(req, auditEntry{
+		Action:  "token-write",
+		Cluster: cluster.Name,
+		Token:   name,
+	}, err)
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	cleanCASAsync()
+}
+
+func wsClusterDeleteToken(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	name := req.PathParameter("token-name")
+
+	if !secretData.DeleteToken(cluster.Name, name) {
+		wsNotFound(req, resp)
+		return
+	}
+
+	err := secretData.Save()
+
+	auditRequest(req, auditEntry{
+		Action:  "token-delete",
+		Cluster: cluster.Name,
+		Token:   name,
+	}, err)
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	cleanCASAsync()
+}
+
+func wsClusterRotateToken(req *restful.Request, resp *restful.Response) {
+	cluster := wsReadCluster(req, resp)
+	if cluster == nil {
+		return
+	}
+
+	if !wsLoadSecretData(resp) {
+		return
+	}
+
+	name := req.PathParameter("token-name")
+
+	token, err := secretData.RotateToken(cluster.Name, name)
+	if err == nil {
+		err = secretData.Save()
+	}
+
+	auditRequest(req, auditEntry{
+		Action:  "token-rotate",
+		Cluster: cluster.Name,
+		Token:   name,
+	}, err)
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	cleanCASAsync()
+
+	resp.WriteEntity(token)
 }
 
 func wsClusterBootstrapPods(req *restful.Request, resp *restful.Response) {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+func TestWsClusterSetSecrets(t *testing.T) {
+	defer withSecretStore(t, newTestSecretKey(t))()
+	defer withConfig(t)()
+
+	writeTestConfig(t, "clusters: [{name: c1}]\n")
+
+	prev := casStore
+	defer func() { casStore = prev }()
+
+	store := &memCASStore{entries: map[string][]byte{}}
+	casStore = store
+
+	ws := (&restful.WebService{}).Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
+	ws.Route(ws.PUT("/clusters/{cluster-name}/passwords/{password-name}").To(wsClusterSetPassword))
+	ws.Route(ws.PUT("/clusters/{cluster-name}/tokens/{token-name}").To(wsClusterSetToken))
+
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	for _, tc := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/clusters/c1/passwords/p1", "not JSON", http.StatusBadRequest},
+		{"/clusters/c1/passwords/p1", `""`, http.StatusBadRequest},
+		{"/clusters/c2/passwords/p1", `"secret"`, http.StatusNotFound},
+		{"/clusters/c1/tokens/t1", "not JSON", http.StatusBadRequest},
+		{"/clusters/c1/tokens/t1", `""`, http.StatusBadRequest},
+		{"/clusters/c1/passwords/p1", `"secret"`, http.StatusOK},
+		{"/clusters/c1/tokens/t1", `"token"`, http.StatusOK},
+	} {
+		// changes clean the cache in the background
+		store.entries["stale/config"] = nil
+
+		r := httptest.NewRequest(http.MethodPut, tc.path, strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", restful.MIME_JSON)
+
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, r)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.path, tc.body, tc.status, rec.Code)
+		}
+
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if tags, _ := store.Tags(); len(tags) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: cache not cleaned", tc.path)
+			}
+		}
+
+		// wait for the cleaner to finish
+		cleanCASMutex.Lock()
+		cleanCASMutex.Unlock()
+	}
+
+	if p := secretData.Password("c1", "p1"); p != "secret" {
+		t.Errorf("unexpected password: %q", p)
+	}
+	if tok, _ := secretData.Token("c1", "t1"); tok != "token" {
+		t.Errorf("unexpected token: %q", tok)
+	}
+}
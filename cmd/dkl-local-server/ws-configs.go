@@ -1,27 +1,128 @@
 package main
 
 import (
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
+
+	"novit.nc/direktil/local-server/pkg/mime"
 )
 
 func wsUploadConfig(req *restful.Request, resp *restful.Response) {
 	body := req.Request.Body
 
-	err := writeNewConfig(body)
+	prewarm := req.QueryParameter("prewarm") == "true"
+
+	var previousTags map[string]string
+	if prewarm {
+		tags, err := currentTags()
+		if err != nil {
+			log.Print("prewarm: failed to get the current tags, building every host: ", err)
+		}
+		previousTags = tags
+	}
+
+	meta := &configMeta{Uploader: requestIdentity(req)}
+
+	if sig := req.HeaderParameter("X-Config-Signature"); sig != "" {
+		var err error
+		meta.Signature, err = base64.StdEncoding.DecodeString(sig)
+		if err != nil {
+			body.Close()
+			resp.WriteErrorString(http.StatusBadRequest, "invalid signature encoding: "+err.Error())
+			return
+		}
+	}
+
+	archiveID, etag, err := writeNewConfig(body, req.HeaderParameter("If-Match"), meta)
 	body.Close()
 
+	auditRequest(req, auditEntry{Action: "config-upload"}, err)
+
 	if err != nil {
+		log.Print("rejected config upload: ", err)
+		wsConfigWriteError(resp, err)
+		return
+	}
+
+	setConfigWriteHeaders(resp, archiveID, etag)
+
+	if !prewarm {
+		return
+	}
+
+	hostNames, err := changedHosts(previousTags)
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	queued, err := jobs.Queue(hostNames, nil)
+	if err != nil && err != errQueueFull {
 		wsError(resp, err)
+		return
 	}
+
+	wsQueuedBuilds(resp, queued, err)
 }
 
-func writeNewConfig(reader io.Reader) (err error) {
+var (
+	configUploadMutex sync.Mutex
+
+	errConfigChanged = errors.New("config changed")
+)
+
+// configETag returns the ETag of the current config, or an empty string if there's none.
+func configETag() (etag string, err error) {
+	f, err := os.Open(configFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+
+	return etagOf(h.Sum(nil)), nil
+}
+
+func etagOf(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// etagMatches checks an If-Match header value against an ETag.
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == etag || (candidate == "*" && etag != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNewConfig validates and activates a new config, returning the ID of the
+// previous config's archive and the new config's ETag. If ifMatch is not empty,
+// the current config must match it, or errConfigChanged is returned.
+// The meta is saved with the config, after the signature is checked (when required).
+func writeNewConfig(reader io.Reader, ifMatch string, meta *configMeta) (archiveID, etag string, err error) {
 	out, err := ioutil.TempFile(*dataDir, ".config-upload")
 	if err != nil {
 		return
@@ -29,47 +130,251 @@ func writeNewConfig(reader io.Reader) (err error) {
 
 	defer os.Remove(out.Name())
 
-	_, err = io.Copy(out, reader)
+	h := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(out, h), reader)
 	out.Close()
 	if err != nil {
 		return
 	}
 
-	archivesPath := filepath.Join(*dataDir, "archives")
-	cfgPath := configFilePath()
+	if configSignaturesRequired() {
+		var content []byte
+		content, err = ioutil.ReadFile(out.Name())
+		if err != nil {
+			return
+		}
+
+		meta.Signer, err = verifyConfigSignature(content, meta.Signature)
+		if err != nil {
+			return
+		}
+	}
+
+	if _, err = validateConfigFile(out.Name()); err != nil {
+		return
+	}
+
+	configUploadMutex.Lock()
+	defer configUploadMutex.Unlock()
+
+	unlock, err := lockConfigFiles(true)
+	if err != nil {
+		return
+	}
+
+	defer unlock()
+
+	if ifMatch != "" {
+		var current string
+		current, err = configETag()
+		if err != nil {
+			return
+		}
+
+		if !etagMatches(ifMatch, current) {
+			err = errConfigChanged
+			return
+		}
+	}
+
+	archiveID, err = archiveCurrentConfig()
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(out.Name(), configFilePath())
+	if err != nil {
+		return
+	}
+
+	etag = etagOf(h.Sum(nil))
+
+	meta.Time = time.Now()
+	if err = writeConfigMeta(configMetaPath(), meta); err != nil {
+		log.Print("failed to write the config meta: ", err)
+
+		// the previous config's meta must not stay with this one
+		if err = os.Remove(configMetaPath()); err != nil && !os.IsNotExist(err) {
+			log.Print("failed to remove the previous config meta: ", err)
+		}
+	}
+
+	err = reloadConfig()
+	return
+}
+
+// wsConfigWriteError sends an error returned by writeNewConfig.
+func wsConfigWriteError(resp *restful.Response, err error) {
+	if verr, ok := err.(*configValidationError); ok {
+		resp.WriteHeaderAndEntity(http.StatusBadRequest, verr)
+		return
+	}
+
+	switch err {
+	case errConfigChanged:
+		resp.WriteErrorString(http.StatusPreconditionFailed, "config changed since it was read")
+
+	case errConfigNotSigned, errConfigBadSignature:
+		resp.WriteErrorString(http.StatusForbidden, err.Error())
+
+	default:
+		wsError(resp, err)
+	}
+}
+
+// setConfigWriteHeaders sends the result of writeNewConfig.
+func setConfigWriteHeaders(resp *restful.Response, archiveID, etag string) {
+	resp.Header().Set("ETag", etag)
+	if archiveID != "" {
+		resp.Header().Set("X-Archive-ID", archiveID)
+	}
+}
+
+func wsCurrentConfig(req *restful.Request, resp *restful.Response) {
+	configUploadMutex.Lock()
+	ba, err := ioutil.ReadFile(configFilePath())
+	configUploadMutex.Unlock()
+
+	if os.IsNotExist(err) {
+		wsNotFound(req, resp)
+		return
+	} else if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	h := sha256.New()
+	h.Write(ba)
+	etag := etagOf(h.Sum(nil))
+
+	resp.Header().Set("ETag", etag)
+
+	if etagMatches(req.HeaderParameter("If-None-Match"), etag) {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-	err = os.MkdirAll(archivesPath, 0700)
+	resp.Header().Set("Content-Type", mime.YAML)
+	resp.Write(ba)
+}
+
+func wsListArchives(req *restful.Request, resp *restful.Response) {
+	archives, err := listArchives()
 	if err != nil {
+		wsError(resp, err)
 		return
 	}
 
-	backupPath := filepath.Join(archivesPath, "config."+ulid()+".yaml.gz")
+	resp.WriteEntity(archives)
+}
+
+func wsArchive(req *restful.Request, resp *restful.Response) {
+	archive, err := openArchive(req.PathParameter("archive-id"))
+	if err == errNoSuchArchive {
+		wsNotFound(req, resp)
+		return
+	} else if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	defer archive.Close()
+
+	resp.Header().Set("Content-Type", mime.YAML)
+	io.Copy(resp, archive)
+}
+
+func wsRestoreArchive(req *restful.Request, resp *restful.Response) {
+	id := req.PathParameter("archive-id")
+
+	archive, err := openArchive(id)
+	if err == errNoSuchArchive {
+		wsNotFound(req, resp)
+		return
+	} else if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	meta := &configMeta{
+		Uploader: requestIdentity(req),
+		Restored: id,
+	}
+
+	// the archived config keeps its signature
+	if archivedMeta, err := archiveMeta(id); err != nil {
+		archive.Close()
+		wsError(resp, err)
+		return
+	} else if archivedMeta != nil {
+		meta.Signature = archivedMeta.Signature
+	}
+
+	archiveID, etag, err := writeNewConfig(archive, req.HeaderParameter("If-Match"), meta)
+	archive.Close()
+
+	auditRequest(req, auditEntry{Action: "config-restore " + id}, err)
 
-	bck, err := os.Create(backupPath)
 	if err != nil {
+		wsConfigWriteError(resp, err)
 		return
 	}
 
-	defer bck.Close()
+	setConfigWriteHeaders(resp, archiveID, etag)
+	resp.WriteEntity(archiveID)
+}
 
-	in, err := os.Open(cfgPath)
+func wsDiffConfig(req *restful.Request, resp *restful.Response) {
+	current, err := readConfig()
 	if err != nil {
+		wsError(resp, err)
 		return
 	}
 
-	gz, err := gzip.NewWriterLevel(bck, 2)
+	var candidate io.ReadCloser = req.Request.Body
+
+	if id := req.QueryParameter("archive"); id != "" {
+		candidate.Close()
+
+		candidate, err = openArchive(id)
+		if err == errNoSuchArchive {
+			wsNotFound(req, resp)
+			return
+		} else if err != nil {
+			wsError(resp, err)
+			return
+		}
+	}
+
+	cfg, err := readConfigFrom(candidate)
+	candidate.Close()
+
 	if err != nil {
+		resp.WriteErrorString(http.StatusBadRequest, "failed to parse the config: "+err.Error())
 		return
 	}
 
-	_, err = io.Copy(gz, in)
-	gz.Close()
-	in.Close()
+	resp.WriteEntity(diffConfigs(current, cfg))
+}
+
+func wsBackup(req *restful.Request, resp *restful.Response) {
+	withDist := req.QueryParameter("dist") == "true"
+
+	recipient, err := backupRecipientKey()
+
+	auditRequest(req, auditEntry{Action: "backup"}, err)
 
 	if err != nil {
+		wsError(resp, err)
 		return
 	}
 
-	err = os.Rename(out.Name(), cfgPath)
-	return
+	resp.Header().Set("Content-Type", mime.GZIP)
+	resp.Header().Set("Content-Disposition", `attachment; filename="backup-`+time.Now().UTC().Format("20060102T150405Z")+`.tar.gz"`)
+
+	// the status is already sent, an error can only truncate the stream (and its manifest)
+	if err := writeBackup(resp, withDist, recipient); err != nil {
+		log.Print("backup failed: ", err)
+	}
 }
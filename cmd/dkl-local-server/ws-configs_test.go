@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+
+	for _, tc := range []struct {
+		ifMatch string
+		etag    string
+		expect  bool
+	}{
+		{`"abc"`, etag, true},
+		{`"def"`, etag, false},
+		{`"def", "abc"`, etag, true},
+		{`"def","abc"`, etag, true},
+		{` "abc" `, etag, true},
+		{`abc`, etag, false},
+		{`W/"abc"`, etag, false},
+		{`*`, etag, true},
+		// no current config
+		{`*`, "", false},
+		{`"abc"`, "", false},
+		{``, etag, false},
+	} {
+		if m := etagMatches(tc.ifMatch, tc.etag); m != tc.expect {
+			t.Errorf("etagMatches(%q, %q): expected %v, got %v", tc.ifMatch, tc.etag, tc.expect, m)
+		}
+	}
+}
+
+func TestEtagOf(t *testing.T) {
+	if etag := etagOf([]byte{0xab, 0x01}); etag != `"ab01"` {
+		t.Errorf("unexpected etag: %s", etag)
+	}
+}
+
+func TestWriteNewConfigArchivesMeta(t *testing.T) {
+	initUlid()
+	defer withSecretStore(t, newTestSecretKey(t))()
+	defer withConfig(t)()
+
+	for _, uploader := range []string{"first", "second"} {
+		if _, _, err := writeNewConfig(strings.NewReader("hosts: []\n"), "", &configMeta{Uploader: uploader}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if meta, err := readConfigMeta(configMetaPath()); err != nil || meta == nil || meta.Uploader != "second" {
+		t.Errorf("unexpected config meta: %+v, %v", meta, err)
+	}
+
+	archives, err := listArchives()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archives) != 1 {
+		t.Fatalf("expected 1 archive, got %d", len(archives))
+	}
+
+	if meta, err := archiveMeta(archives[0].ID); err != nil || meta == nil || meta.Uploader != "first" {
+		t.Errorf("unexpected archive meta: %+v, %v", meta, err)
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"flag"
+	"io"
 	"log"
 	"net/http"
 	"path"
@@ -12,23 +12,25 @@ import (
 	"novit.nc/direktil/pkg/localconfig"
 )
 
-var trustXFF = flag.Bool("trust-xff", true, "Trust the X-Forwarded-For header")
-
 type wsHost struct {
 	prefix  string
 	hostDoc string
 	getHost func(req *restful.Request) string
 }
 
-func (ws *wsHost) register(rws *restful.WebService, alterRB func(*restful.RouteBuilder)) {
+// register adds the host's routes; alterRB is called with artifact set for every route but the details one.
+func (ws *wsHost) register(rws *restful.WebService, alterRB func(rb *restful.RouteBuilder, artifact bool)) {
 	b := func(what string) *restful.RouteBuilder {
 		return rws.GET(ws.prefix + "/" + what).To(ws.render)
 	}
 
-	for _, rb := range []*restful.RouteBuilder{
-		rws.GET(ws.prefix).To(ws.get).
-			Doc("Get the " + ws.hostDoc + "'s details"),
+	details := rws.GET(ws.prefix).To(ws.get).
+		Doc("Get the " + ws.hostDoc + "'s details")
+
+	alterRB(details, false)
+	rws.Route(details)
 
+	for _, rb := range []*restful.RouteBuilder{
 		// raw configuration
 		b("config").
 			Produces(mime.YAML).
@@ -73,7 +75,7 @@ func (ws *wsHost) register(rws *restful.WebService, alterRB func(*restful.RouteB
 			Produces(mime.OCTET).
 			Doc("Get the " + ws.hostDoc + "'s initial RAM disk (ie: for netboot)"),
 	} {
-		alterRB(rb)
+		alterRB(rb, true)
 		rws.Route(rb)
 	}
 }
@@ -117,17 +119,45 @@ func (ws *wsHost) render(req *restful.Request, resp *restful.Response) {
 
 	what := path.Base(req.Request.URL.Path)
 
-	renderHost(resp.ResponseWriter, req.Request, what, host, cfg)
+	ctx, err := renderHost(resp.ResponseWriter, req.Request, what, host, cfg)
+
+	if ctx == nil {
+		return
+	}
+
+	if secrets := ctx.SecretsUsed(); len(secrets) != 0 {
+		meta, _ := readHostMeta(host.Name)
+
+		auditRequest(req, auditEntry{
+			Action:  "render",
+			Cluster: meta.Cluster,
+			Host:    host.Name,
+			Secrets: secrets,
+		}, err)
+	}
+}
+
+// artifactBuilders are the builders of the artifacts stored in the CAS
+var artifactBuilders = map[string]func(out io.Writer, ctx *renderContext) error{
+	"initrd":       buildInitrd,
+	"boot.iso":     buildBootISO,
+	"boot.tar":     buildBootTar,
+	"boot.img":     buildBootImg,
+	"boot.img.gz":  buildBootImgGZ,
+	"boot.img.lz4": buildBootImgLZ4,
 }
 
-func renderHost(w http.ResponseWriter, r *http.Request, what string, host *localconfig.Host, cfg *localconfig.Config) {
-	ctx, err := newRenderContext(host, cfg)
+// renderHost sends the host's artifact, returning the render context once created and the render error.
+func renderHost(w http.ResponseWriter, r *http.Request, what string, host *localconfig.Host, cfg *localconfig.Config) (ctx *renderContext, err error) {
+	ctx, err = newRenderContext(host, cfg)
 	if err != nil {
 		log.Printf("host %s: %s: failed to render: %v", what, host.Name, err)
 		http.Error(w, "", http.StatusServiceUnavailable)
 		return
 	}
 
+	artifactRequestsMetric.WithLabelValues(what).Inc()
+
 	switch what {
 	case "config":
 		err = renderConfig(w, r, ctx, false)
@@ -141,30 +171,20 @@ func renderHost(w http.ResponseWriter, r *http.Request, what string, host *local
 	case "kernel":
 		err = renderKernel(w, r, ctx)
 
-	case "initrd":
-		err = renderCtx(w, r, ctx, what, buildInitrd)
-
-	case "boot.iso":
-		err = renderCtx(w, r, ctx, what, buildBootISO)
-
-	case "boot.tar":
-		err = renderCtx(w, r, ctx, what, buildBootTar)
-
-	case "boot.img":
-		err = renderCtx(w, r, ctx, what, buildBootImg)
-
-	case "boot.img.gz":
-		err = renderCtx(w, r, ctx, what, buildBootImgGZ)
-
-	case "boot.img.lz4":
-		err = renderCtx(w, r, ctx, what, buildBootImgLZ4)
-
 	default:
-		http.NotFound(w, r)
+		build, ok := artifactBuilders[what]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		err = renderCtx(w, r, ctx, what, measureBuild(what, build))
 	}
 
 	if err != nil {
 		log.Printf("host %s: %s: failed to render: %v", what, host.Name, err)
 		http.Error(w, "", http.StatusServiceUnavailable)
 	}
+
+	return
 }
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	restful "github.com/emicklei/go-restful"
+	"novit.nc/direktil/pkg/localconfig"
 )
 
 func wsListHosts(req *restful.Request, resp *restful.Response) {
@@ -13,10 +14,87 @@ func wsListHosts(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
-	names := make([]string, len(cfg.Hosts))
-	for i, host := range cfg.Hosts {
-		names[i] = host.Name
+	cred := requestAdmin(req)
+
+	names := make([]string, 0, len(cfg.Hosts))
+	for _, host := range cfg.Hosts {
+		// without host metadata, restricted credentials see no host
+		if allowed, _ := cred.AllowsHost(host.Name); allowed {
+			names = append(names, host.Name)
+		}
 	}
 
 	resp.WriteEntity(names)
 }
+
+func wsReadHost(req *restful.Request, resp *restful.Response) (host *localconfig.Host) {
+	cfg := wsReadConfig(resp)
+	if cfg == nil {
+		return
+	}
+
+	host = cfg.Host(req.PathParameter("host-name"))
+	if host == nil {
+		wsNotFound(req, resp)
+		return
+	}
+
+	if err := loadSecretDataFor(cfg); err != nil {
+		wsError(resp, err)
+		return nil
+	}
+
+	return
+}
+
+func wsHostToken(req *restful.Request, resp *restful.Response) {
+	host := wsReadHost(req, resp)
+	if host == nil {
+		return
+	}
+
+	token, err := secretData.HostToken(host.Name)
+
+	auditRequest(req, auditEntry{
+		Action: "host-token-read",
+		Host:   host.Name,
+	}, err)
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	if secretData.Changed() {
+		if err := secretData.Save(); err != nil {
+			wsError(resp, err)
+			return
+		}
+	}
+
+	resp.WriteEntity(token)
+}
+
+func wsRotateHostToken(req *restful.Request, resp *restful.Response) {
+	host := wsReadHost(req, resp)
+	if host == nil {
+		return
+	}
+
+	token, err := secretData.RotateHostToken(host.Name)
+	if err == nil {
+		err = secretData.Save()
+	}
+
+	auditRequest(req, auditEntry{
+		Action: "host-token-rotate",
+		Host:   host.Name,
+	}, err)
+
+	if err != nil {
+		wsError(resp, err)
+		return
+	}
+
+	resp.WriteEntity(token)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+
+	restful "github.com/emicklei/go-restful"
+
+	"novit.nc/direktil/local-server/pkg/mime"
+)
+
+func wsQueueHostBuilds(req *restful.Request, resp *restful.Response) {
+	hostName := req.PathParameter("host-name")
+
+	wsQueueBuilds(req, resp, false, func(name string, _ hostMeta) bool {
+		return name == hostName
+	})
+}
+
+func wsQueueGroupBuilds(req *restful.Request, resp *restful.Response) {
+	group := req.PathParameter("group-name")
+
+	wsQueueBuilds(req, resp, true, func(_ string, meta hostMeta) bool {
+		return meta.Group == group
+	})
+}
+
+func wsQueueClusterBuilds(req *restful.Request, resp *restful.Response) {
+	cluster := req.PathParameter("cluster-name")
+
+	wsQueueBuilds(req, resp, true, func(_ string, meta hostMeta) bool {
+		return meta.Cluster == cluster
+	})
+}
+
+// wsQueueBuilds queues the builds of the matching hosts. When byPlacement is
+// true, the match uses the host metadata, so the config must have it.
+func wsQueueBuilds(req *restful.Request, resp *restful.Response, byPlacement bool, match func(hostName string, meta hostMeta) bool) {
+	cfg := wsReadConfig(resp)
+	if cfg == nil {
+		return
+	}
+
+	cred := requestAdmin(req)
+
+	hostNames := make([]string, 0)
+	for _, host := range cfg.Hosts {
+		var meta hostMeta
+		if byPlacement {
+			var err error
+			meta, err = readHostMeta(host.Name)
+			if err != nil {
+				wsHostMetaError(resp, err)
+				return
+			}
+		}
+
+		if !match(host.Name, meta) {
+			continue
+		}
+
+		allowed, err := cred.AllowsHost(host.Name)
+		if err != nil {
+			wsHostMetaError(resp, err)
+			return
+		}
+
+		if allowed {
+			hostNames = append(hostNames, host.Name)
+		}
+	}
+
+	if len(hostNames) == 0 {
+		wsNotFound(req, resp)
+		return
+	}
+
+	queued, err := jobs.Queue(hostNames, req.QueryParameters("kind"))
+	if err != nil && err != errQueueFull {
+		resp.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wsQueuedBuilds(resp, queued, err)
+}
+
+// queuedBuilds is the response to a build request the queue couldn't fully accept.
+type queuedBuilds struct {
+	Error  string
+	Queued []buildJob
+}
+
+// wsQueuedBuilds sends the jobs queued by jobs.Queue. When the queue was full
+// (err is errQueueFull), the jobs queued before are listed with a 503 status.
+func wsQueuedBuilds(resp *restful.Response, queued []buildJob, err error) {
+	if err == errQueueFull {
+		resp.WriteHeaderAndEntity(http.StatusServiceUnavailable, queuedBuilds{Error: err.Error(), Queued: queued})
+		return
+	}
+
+	resp.WriteHeaderAndEntity(http.StatusAccepted, queued)
+}
+
+// wsHostMetaError sends an error returned by readHostMeta.
+func wsHostMetaError(resp *restful.Response, err error) {
+	if err == errNoHostMeta {
+		resp.WriteErrorString(http.StatusConflict, err.Error())
+		return
+	}
+
+	wsError(resp, err)
+}
+
+func wsListJobs(req *restful.Request, resp *restful.Response) {
+	resp.WriteEntity(jobs.List())
+}
+
+func wsJob(req *restful.Request, resp *restful.Response) {
+	job, _, found := jobs.Get(req.PathParameter("job-id"))
+	if !found {
+		wsNotFound(req, resp)
+		return
+	}
+
+	resp.WriteEntity(job)
+}
+
+func wsJobLog(req *restful.Request, resp *restful.Response) {
+	_, jobLog, found := jobs.Get(req.PathParameter("job-id"))
+	if !found {
+		wsNotFound(req, resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", mime.TEXT)
+	resp.Write(jobLog)
+}
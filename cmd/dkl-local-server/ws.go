@@ -1,12 +1,13 @@
 package main
 
 import (
+	"flag"
 	"log"
-	"net"
 	"net/http"
 	"strings"
 
 	"github.com/emicklei/go-restful"
+	"novit.nc/direktil/local-server/pkg/macaddr"
 	"novit.nc/direktil/local-server/pkg/mime"
 	"novit.nc/direktil/pkg/localconfig"
 )
@@ -14,41 +15,221 @@ import (
 func registerWS(rest *restful.Container) {
 	// Admin-level APIs
 	ws := &restful.WebService{}
+	ws.Filter(metricsFilter)
 	ws.Filter(adminAuth).
 		HeaderParameter("Authorization", "Admin bearer token")
 
 	// - configs API
+	ws.Route(ws.GET("/configs/current").To(wsCurrentConfig).
+		Produces(mime.YAML).
+		Doc("Get the current configuration, with its ETag").
+		Param(ws.HeaderParameter("If-None-Match", "ETag of the configuration known by the client")).
+		Returns(http.StatusNotModified, "The configuration matches If-None-Match", nil).
+		Filter(requireGlobalScope(scopeConfigsRead)))
+
 	ws.Route(ws.POST("/configs").To(wsUploadConfig).
-		Doc("Upload a new current configuration, archiving the previous one"))
+		Param(ws.QueryParameter("prewarm", "Queue builds for every host whose tag changed").DataType("boolean")).
+		Param(ws.HeaderParameter("If-Match", "ETag the current configuration must match")).
+		Param(ws.HeaderParameter("X-Config-Signature", "Base64 ed25519 signature of the configuration (required with -config-signers)")).
+		Doc("Upload a new current configuration, archiving the previous one").
+		Notes("The configuration is validated (parsing and dry-run render of every host) before being activated. "+
+			"The response has the new configuration's ETag and the previous one's archive ID (X-Archive-ID header)").
+		Returns(http.StatusOK, "OK", nil).
+		Returns(http.StatusBadRequest, "The configuration is invalid", configValidationError{}).
+		Returns(http.StatusPreconditionFailed, "The current configuration doesn't match If-Match", nil).
+		Returns(http.StatusForbidden, "The configuration's signature is missing or invalid", nil).
+		Returns(http.StatusAccepted, "OK, with prewarm: the queued builds", []buildJob{}).
+		Returns(http.StatusServiceUnavailable, "With prewarm: the configuration is saved but the build queue is full", queuedBuilds{}).
+		Filter(requireGlobalScope(scopeConfigsWrite)))
+
+	ws.Route(ws.POST("/configs/diff").To(wsDiffConfig).
+		Doc("Compare the current config with a candidate one (the body) or an archived one").
+		Param(ws.QueryParameter("archive", "ID of the archived config to compare with (instead of the body)")).
+		Returns(http.StatusOK, "OK", []hostDiff{}).
+		Filter(requireGlobalScope(scopeConfigsRead)))
+	ws.Route(ws.GET("/configs/archives").To(wsListArchives).
+		Doc("List the config archives, newest first").
+		Filter(requireGlobalScope(scopeConfigsRead)))
+	ws.Route(ws.GET("/configs/archives/{archive-id}").To(wsArchive).
+		Produces(mime.YAML).
+		Doc("Get an archived config").
+		Filter(requireGlobalScope(scopeConfigsRead)))
+	ws.Route(ws.POST("/configs/archives/{archive-id}/restore").To(wsRestoreArchive).
+		Param(ws.HeaderParameter("If-Match", "ETag the current configuration must match")).
+		Doc("Restore an archived config as the current one, archiving the current one").
+		Returns(http.StatusOK, "OK (the ID of the replaced config's archive)", "").
+		Returns(http.StatusBadRequest, "The archived configuration is invalid", configValidationError{}).
+		Filter(requireGlobalScope(scopeConfigsWrite)))
+
+	// - backup API
+	ws.Route(ws.GET("/backup").To(wsBackup).
+		Produces(mime.GZIP).
+		Param(ws.QueryParameter("dist", "Include the dist files").DataType("boolean")).
+		Doc("Stream a backup of the server state (config, secrets, config archives and optionally dist)").
+		Notes("The secrets are encrypted to the -backup-recipient key if set. Restore with the -restore option, server stopped.").
+		Filter(requireGlobalScope(scopeAll)))
+
+	// - build jobs API
+	kindParam := ws.QueryParameter("kind", "Artifact kind to build (repeatable, defaults to the server's build kinds)")
+
+	ws.Route(ws.POST("/hosts/{host-name}/builds").To(wsQueueHostBuilds).
+		Param(kindParam).
+		Doc("Queue builds for a host").
+		Returns(http.StatusAccepted, "The queued builds", []buildJob{}).
+		Returns(http.StatusServiceUnavailable, "The build queue is full, some builds may be queued", queuedBuilds{}).
+		Filter(requireScope(scopeArtifacts)))
+	ws.Route(ws.POST("/groups/{group-name}/builds").To(wsQueueGroupBuilds).
+		Param(kindParam).
+		Doc("Queue builds for every host of a group").
+		Returns(http.StatusAccepted, "The queued builds", []buildJob{}).
+		Returns(http.StatusServiceUnavailable, "The build queue is full, some builds may be queued", queuedBuilds{}).
+		Returns(http.StatusConflict, "The configuration has no host metadata", nil).
+		Filter(requireScope(scopeArtifacts)))
+	ws.Route(ws.POST("/clusters/{cluster-name}/builds").To(wsQueueClusterBuilds).
+		Param(kindParam).
+		Doc("Queue builds for every host of a cluster").
+		Returns(http.StatusAccepted, "The queued builds", []buildJob{}).
+		Returns(http.StatusServiceUnavailable, "The build queue is full, some builds may be queued", queuedBuilds{}).
+		Returns(http.StatusConflict, "The configuration has no host metadata", nil).
+		Filter(requireScope(scopeArtifacts)))
+
+	ws.Route(ws.GET("/jobs").To(wsListJobs).
+		Doc("List build jobs").
+		Filter(requireGlobalScope(scopeRead)))
+	ws.Route(ws.GET("/jobs/{job-id}").To(wsJob).
+		Doc("Get a build job's state and timings").
+		Filter(requireGlobalScope(scopeRead)))
+	ws.Route(ws.GET("/jobs/{job-id}/log").To(wsJobLog).
+		Produces(mime.TEXT).
+		Doc("Get a build job's log").
+		Filter(requireGlobalScope(scopeRead)))
+
+	// - audit API
+	ws.Route(ws.GET("/audit").To(wsAudit).
+		Param(ws.QueryParameter("offset", "Index of the first entry").DataType("integer")).
+		Param(ws.QueryParameter("limit", "Maximum number of entries (default 100)").DataType("integer")).
+		Doc("List the audit log entries, oldest first").
+		Filter(requireGlobalScope(scopeAuditRead)))
+
+	// - certificates API
+	ws.Route(ws.GET("/certificates/renewals").To(wsCertRenewals).
+		Param(ws.QueryParameter("within", "Duration to look ahead (default 720h)")).
+		Doc("List the certificates to renew, soonest first").
+		Returns(http.StatusOK, "OK", []certRenewal{}).
+		Filter(requireScope(scopeRead)))
 
 	// - clusters API
 	ws.Route(ws.GET("/clusters").To(wsListClusters).
-		Doc("List clusters"))
+		Doc("List clusters").
+		Filter(requireScope(scopeRead)))
 
 	ws.Route(ws.GET("/clusters/{cluster-name}").To(wsCluster).
-		Doc("Get cluster details"))
+		Doc("Get cluster details").
+		Filter(requireScope(scopeRead)))
 
 	ws.Route(ws.GET("/clusters/{cluster-name}/addons").To(wsClusterAddons).
 		Produces(mime.YAML).
 		Doc("Get cluster addons").
 		Returns(http.StatusOK, "OK", nil).
-		Returns(http.StatusNotFound, "The cluster does not exists or does not have addons defined", nil))
+		Returns(http.StatusNotFound, "The cluster does not exists or does not have addons defined", nil).
+		Filter(requireScope(scopeRead)))
 
 	ws.Route(ws.GET("/clusters/{cluster-name}/bootstrap-pods").To(wsClusterBootstrapPods).
 		Produces(mime.YAML).
 		Doc("Get cluster bootstrap pods YAML definitions").
 		Returns(http.StatusOK, "OK", nil).
-		Returns(http.StatusNotFound, "The cluster does not exists or does not have bootstrap pods defined", nil))
+		Returns(http.StatusNotFound, "The cluster does not exists or does not have bootstrap pods defined", nil).
+		Filter(requireScope(scopeRead)))
 
 	ws.Route(ws.GET("/clusters/{cluster-name}/passwords").To(wsClusterPasswords).
-		Doc("List cluster's passwords"))
+		Doc("List cluster's passwords").
+		Filter(requireScope(scopePasswordsRead)))
 	ws.Route(ws.GET("/clusters/{cluster-name}/passwords/{password-name}").To(wsClusterPassword).
-		Doc("Get cluster's password"))
+		Doc("Get cluster's password").
+		Filter(requireScope(scopePasswordsRead)))
 	ws.Route(ws.PUT("/clusters/{cluster-name}/passwords/{password-name}").To(wsClusterSetPassword).
-		Doc("Set cluster's password"))
+		Doc("Set cluster's password").
+		Filter(requireScope(scopePasswordsWrite)))
+	ws.Route(ws.DELETE("/clusters/{cluster-name}/passwords/{password-name}").To(wsClusterDeletePassword).
+		Doc("Delete cluster's password").
+		Filter(requireScope(scopePasswordsWrite)))
+	ws.Route(ws.POST("/clusters/{cluster-name}/passwords/{password-name}/generate").To(wsClusterGeneratePassword).
+		Doc("Set cluster's password to a random one, returning it").
+		Param(ws.QueryParameter("length", "Password length (default 32)").DataType("integer")).
+		Filter(requireScope(scopePasswordsWrite)))
+
+	ws.Route(ws.GET("/clusters/{cluster-name}/tokens").To(wsClusterTokens).
+		Doc("List cluster's tokens").
+		Filter(requireScope(scopeTokensRead)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/tokens/{token-name}").To(wsClusterToken).
+		Doc("Get cluster's token").
+		Filter(requireScope(scopeTokensRead)))
+	ws.Route(ws.PUT("/clusters/{cluster-name}/tokens/{token-name}").To(wsClusterSetToken).
+		Doc("Set cluster's token").
+		Filter(requireScope(scopeTokensWrite)))
+	ws.Route(ws.DELETE("/clusters/{cluster-name}/tokens/{token-name}").To(wsClusterDeleteToken).
+		Doc("Delete cluster's token (it will be generated again when used)").
+		Filter(requireScope(scopeTokensWrite)))
+	ws.Route(ws.POST("/clusters/{cluster-name}/tokens/{token-name}/rotate").To(wsClusterRotateToken).
+		Doc("Replace cluster's token with a new random one, returning it").
+		Filter(requireScope(scopeTokensWrite)))
+
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs").To(wsClusterCAs).
+		Doc("List cluster's CAs").
+		Returns(http.StatusOK, "OK", []caInfo{}).
+		Filter(requireScope(scopeRead)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}").To(wsClusterCA).
+		Doc("Get cluster's CA, with the certificates it signed").
+		Returns(http.StatusOK, "OK", caInfo{}).
+		Filter(requireScope(scopeRead)))
+	ws.Route(ws.PUT("/clusters/{cluster-name}/CAs/{ca-name}").To(wsClusterImportCA).
+		Doc("Import an externally generated CA in the cluster").
+		Notes("The certificate must be a CA matching the key, and be either self-signed or given with its chain").
+		Reads(caImport{}).
+		Returns(http.StatusCreated, "Created", nil).
+		Returns(http.StatusBadRequest, "The CA is invalid", nil).
+		Returns(http.StatusConflict, "The CA already exists", nil).
+		Filter(requireScope(scopeCAsWrite)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/ca.pem").To(wsClusterCACert).
+		Produces(mime.PEM).
+		Doc("Get cluster's CA certificate").
+		Filter(requireScope(scopeRead)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/bundle.pem").To(wsClusterCABundle).
+		Produces(mime.PEM).
+		Doc("Get cluster's CA trust bundle (with the successor or previous CA during a rotation)").
+		Filter(requireScope(scopeRead)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/rotation").To(wsClusterCARotation).
+		Doc("Get cluster's CA rotation status").
+		Returns(http.StatusOK, "OK", caRotationInfo{}).
+		Filter(requireScope(scopeRead)))
+	ws.Route(ws.POST("/clusters/{cluster-name}/CAs/{ca-name}/rotation/{action}").To(wsClusterCARotate).
+		Doc("Move cluster's CA rotation to its next phase").
+		Notes("The actions are, in order: generate (a successor CA), bundle (trust both CAs), "+
+			"switch (sign with the successor CA) and retire (stop trusting the previous CA). "+
+			"A rotation can be canceled before the switch.").
+		Param(ws.PathParameter("action", "generate, bundle, switch, retire or cancel")).
+		Returns(http.StatusOK, "OK", caRotationInfo{}).
+		Returns(http.StatusConflict, "The action is not allowed in the CA's rotation phase", nil).
+		Filter(requireScope(scopeCAsWrite)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/signed/{cert-name:*}").To(wsClusterSignedCert).
+		Doc("Get a certificate signed by cluster's CA").
+		Returns(http.StatusOK, "OK", certInfo{}).
+		Filter(requireScope(scopeRead)))
+	ws.Route(ws.GET("/clusters/{cluster-name}/CAs/{ca-name}/chain/{cert-name:*}").To(wsClusterSignedCertChain).
+		Produces(mime.PEM).
+		Doc("Get a certificate signed by cluster's CA, followed by the CA's certificate").
+		Filter(requireScope(scopeRead)))
 
 	ws.Route(ws.GET("/hosts").To(wsListHosts).
-		Doc("List hosts"))
+		Doc("List hosts").
+		Filter(requireScope(scopeRead)))
+
+	ws.Route(ws.GET("/hosts/{host-name}/token").To(wsHostToken).
+		Doc("Get the host's own token").
+		Filter(requireScope(scopeAll)))
+	ws.Route(ws.POST("/hosts/{host-name}/token/rotate").To(wsRotateHostToken).
+		Doc("Replace the host's token with a new one (its boot media will be rebuilt)").
+		Filter(requireScope(scopeAll)))
 
 	(&wsHost{
 		prefix:  "/hosts/{host-name}",
@@ -56,7 +237,12 @@ func registerWS(rest *restful.Container) {
 		getHost: func(req *restful.Request) string {
 			return req.PathParameter("host-name")
 		},
-	}).register(ws, func(rb *restful.RouteBuilder) {
+	}).register(ws, func(rb *restful.RouteBuilder, artifact bool) {
+		if artifact {
+			rb.Filter(requireScope(scopeArtifacts))
+		} else {
+			rb.Filter(requireScope(scopeRead))
+		}
 	})
 
 	rest.Add(ws)
@@ -64,48 +250,117 @@ func registerWS(rest *restful.Container) {
 	// Hosts API
 	ws = &restful.WebService{}
 	ws.Path("/me")
+	ws.Filter(metricsFilter)
+	ws.Filter(logClientFilter)
 	ws.Filter(hostsAuth).
 		HeaderParameter("Authorization", "Host or admin bearer token")
 
+	macParam := ws.QueryParameter("mac", "MAC address of the host (also accepted in the "+macHeader+" header)")
+
 	(&wsHost{
 		hostDoc: "detected host",
 		getHost: detectHost,
-	}).register(ws, func(rb *restful.RouteBuilder) {
-		rb.Notes("In this case, the host is detected from the remote IP")
+	}).register(ws, func(rb *restful.RouteBuilder, artifact bool) {
+		if artifact {
+			rb.Filter(requireMeScope(scopeArtifacts))
+		} else {
+			rb.Filter(requireMeScope(scopeRead))
+		}
+
+		rb.Param(macParam)
+		rb.Notes("In this case, the host is detected using the identifiers trusted by the server (-host-identifiers): its MAC address and/or its remote IP")
 	})
 
 	rest.Add(ws)
 }
 
+const macHeader = "X-Host-MAC"
+
+var hostIdentifiers = flag.String("host-identifiers", "ip", "Comma-separated identifiers used to detect hosts on /me, in order of preference (mac, ip)")
+
 func detectHost(req *restful.Request) string {
-	r := req.Request
-	remoteAddr := r.RemoteAddr
+	if hostName, ok := req.Attribute("host-name").(string); ok {
+		// already detected and authenticated
+		return hostName
+	}
+
+	cfg, err := readConfig()
+	if err != nil {
+		return ""
+	}
 
-	if *trustXFF {
-		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-			remoteAddr = strings.Split(xff, ",")[0]
+	if req.Request.TLS != nil && len(req.Request.TLS.PeerCertificates) != 0 {
+		// a client certificate is authoritative
+		if host := certHost(req.Request, cfg); host != nil {
+			return host.Name
 		}
+		return ""
 	}
 
-	hostIP, _, err := net.SplitHostPort(remoteAddr)
+	for _, identifier := range strings.Split(*hostIdentifiers, ",") {
+		var host *localconfig.Host
 
-	if err != nil {
-		hostIP = remoteAddr
+		switch strings.TrimSpace(identifier) {
+		case "mac":
+			host = detectHostByMAC(req, cfg)
+		case "ip":
+			host = detectHostByIP(req, cfg)
+		default:
+			log.Printf("unknown host identifier %q", identifier)
+		}
+
+		if host != nil {
+			return host.Name
+		}
 	}
 
-	cfg, err := readConfig()
-	if err != nil {
-		return ""
+	return ""
+}
+
+func detectHostByMAC(req *restful.Request, cfg *localconfig.Config) *localconfig.Host {
+	mac := req.QueryParameter("mac")
+	if mac == "" {
+		mac = req.HeaderParameter(macHeader)
+	}
+	if mac == "" {
+		return nil
+	}
+
+	host := hostByMAC(cfg, mac)
+	if host == nil {
+		log.Printf("no host found for MAC %q", mac)
+	}
+
+	return host
+}
+
+// hostByMAC finds the host having the given MAC, whatever the formats used by the request and the config.
+func hostByMAC(cfg *localconfig.Config, mac string) *localconfig.Host {
+	mac = macaddr.Normalize(mac)
+	if mac == "" {
+		return nil
 	}
 
+	for _, host := range cfg.Hosts {
+		for _, hostMAC := range host.MACs {
+			if macaddr.Normalize(hostMAC) == mac {
+				return host
+			}
+		}
+	}
+	return nil
+}
+
+func detectHostByIP(req *restful.Request, cfg *localconfig.Config) *localconfig.Host {
+	hostIP := clientIP(req.Request)
+
 	host := cfg.HostByIP(hostIP)
 
 	if host == nil {
 		log.Print("no host found for IP ", hostIP)
-		return ""
 	}
 
-	return host.Name
+	return host
 }
 
 func wsReadConfig(resp *restful.Response) *localconfig.Config {
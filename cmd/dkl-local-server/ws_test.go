@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+	"novit.nc/direktil/pkg/localconfig"
+)
+
+func TestHostByMAC(t *testing.T) {
+	cfg := &localconfig.Config{
+		Hosts: []*localconfig.Host{
+			{Name: "no-mac"},
+			{Name: "invalid", MACs: []string{"not a MAC"}},
+			{Name: "colons", MACs: []string{"aa:bb:cc:dd:ee:01"}},
+			{Name: "dashes", MACs: []string{"AA-BB-CC-DD-EE-02"}},
+			{Name: "dots", MACs: []string{"aabb.ccdd.ee03"}},
+			{Name: "bare", MACs: []string{"AaBbCcDdEe04"}},
+			{Name: "second", MACs: []string{"aa:bb:cc:dd:ee:05", "aa:bb:cc:dd:ee:06"}},
+		},
+	}
+
+	for mac, expected := range map[string]string{
+		"aa:bb:cc:dd:ee:01": "colons",
+		"AABBCCDDEE01":      "colons",
+		"aa-bb-cc-dd-ee-02": "dashes",
+		"Aa:Bb:Cc:Dd:Ee:02": "dashes",
+		"aabbccddee03":      "dots",
+		"AA:BB:CC:DD:EE:03": "dots",
+		"aabb.ccdd.ee04":    "bare",
+		"aa-bb-cc-dd-ee-04": "bare",
+		"aa:bb:cc:dd:ee:06": "second",
+		"aa:bb:cc:dd:ee:07": "",
+		"":                  "",
+		"::":                "",
+	} {
+		name := ""
+		if host := hostByMAC(cfg, mac); host != nil {
+			name = host.Name
+		}
+
+		if name != expected {
+			t.Errorf("%q: expected host %q, got %q", mac, expected, name)
+		}
+	}
+}
+
+func TestDetectHost(t *testing.T) {
+	defer withConfig(t)()
+	defer withTrustedProxies(t, "", "xff")()
+
+	writeTestConfig(t, `
+hosts:
+- {name: by-mac, macs: ["aa:bb:cc:dd:ee:ff"], ips: [10.0.0.1]}
+- {name: by-ip, ips: [10.0.0.2]}
+`)
+
+	prev := *hostIdentifiers
+	defer func() { *hostIdentifiers = prev }()
+
+	for _, tc := range []struct {
+		identifiers string
+		remoteIP    string
+		mac         string
+		header      bool
+		expect      string
+	}{
+		{"ip", "10.0.0.2", "aa:bb:cc:dd:ee:ff", false, "by-ip"},
+		{"mac,ip", "10.0.0.2", "AA-BB-CC-DD-EE-FF", false, "by-mac"},
+		{"mac,ip", "10.0.0.2", "aabbccddeeff", true, "by-mac"},
+		{"ip,mac", "10.0.0.2", "aa:bb:cc:dd:ee:ff", false, "by-ip"},
+		// falls back to the IP
+		{"mac,ip", "10.0.0.2", "11:22:33:44:55:66", false, "by-ip"},
+		{"mac,ip", "10.0.0.2", "", false, "by-ip"},
+		// MACs not trusted
+		{"ip", "10.0.0.3", "aa:bb:cc:dd:ee:ff", false, ""},
+		{"mac", "10.0.0.2", "", false, ""},
+	} {
+		*hostIdentifiers = tc.identifiers
+
+		r := httptest.NewRequest(http.MethodGet, "/me/config", nil)
+		r.RemoteAddr = tc.remoteIP + ":1234"
+
+		if tc.mac != "" {
+			if tc.header {
+				r.Header.Set(macHeader, tc.mac)
+			} else {
+				q := r.URL.Query()
+				q.Set("mac", tc.mac)
+				r.URL.RawQuery = q.Encode()
+			}
+		}
+
+		if host := detectHost(restful.NewRequest(r)); host != tc.expect {
+			t.Errorf("%+v: expected host %q, got %q", tc, tc.expect, host)
+		}
+	}
+}
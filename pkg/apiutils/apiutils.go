@@ -24,10 +24,6 @@ func Setup(addWebServices func()) {
 	SetupOpenAPI()
 }
 
-func SetupHealth() {
-	// TODO
-}
-
 // SetupOpenAPI creates the standard API documentation endpoint at the default location.
 func SetupOpenAPI() {
 	SetupOpenAPIAt("/swagger.json")
@@ -0,0 +1,100 @@
+package apiutils
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Readiness is the readiness endpoint's response.
+type Readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []CheckResult `json:"checks"`
+}
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	readinessChecksMutex sync.Mutex
+	readinessChecks      []readinessCheck
+)
+
+// AddReadinessCheck registers a check run by the readiness endpoint.
+// The service is ready when every check returns nil.
+func AddReadinessCheck(name string, check func() error) {
+	readinessChecksMutex.Lock()
+	defer readinessChecksMutex.Unlock()
+
+	readinessChecks = append(readinessChecks, readinessCheck{name, check})
+}
+
+// SetupHealth creates the liveness (/healthz) and readiness (/readyz) endpoints.
+func SetupHealth() {
+	ws := &restful.WebService{}
+
+	ws.Route(ws.GET("/healthz").To(healthz).
+		Doc("Liveness probe: the process is alive").
+		Returns(http.StatusOK, "OK", nil))
+
+	ws.Route(ws.GET("/readyz").To(readyz).
+		Doc("Readiness probe: runs every registered check").
+		Writes(Readiness{}).
+		Returns(http.StatusOK, "Ready", Readiness{}).
+		Returns(http.StatusServiceUnavailable, "Not ready", Readiness{}))
+
+	restful.Add(ws)
+}
+
+func healthz(req *restful.Request, resp *restful.Response) {
+	resp.Write([]byte("ok"))
+}
+
+func readyz(req *restful.Request, resp *restful.Response) {
+	readinessChecksMutex.Lock()
+	checks := make([]readinessCheck, len(readinessChecks))
+	copy(checks, readinessChecks)
+	readinessChecksMutex.Unlock()
+
+	result := Readiness{
+		Ready:  true,
+		Checks: make([]CheckResult, len(checks)),
+	}
+
+	for i, c := range checks {
+		start := time.Now()
+		err := c.check()
+
+		r := CheckResult{
+			Name:     c.name,
+			OK:       err == nil,
+			Duration: time.Since(start).String(),
+		}
+
+		if err != nil {
+			r.Error = err.Error()
+			result.Ready = false
+		}
+
+		result.Checks[i] = r
+	}
+
+	status := http.StatusOK
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	resp.WriteHeaderAndEntity(status, result)
+}
@@ -0,0 +1,106 @@
+package apiutils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+var setupHealthOnce sync.Once
+
+// withReadinessChecks replaces the registered checks, returning a function restoring them.
+func withReadinessChecks() (restore func()) {
+	setupHealthOnce.Do(func() {
+		Prepare()
+		SetupHealth()
+	})
+
+	readinessChecksMutex.Lock()
+	prev := readinessChecks
+	readinessChecks = nil
+	readinessChecksMutex.Unlock()
+
+	return func() {
+		readinessChecksMutex.Lock()
+		readinessChecks = prev
+		readinessChecksMutex.Unlock()
+	}
+}
+
+func serveHealth(t *testing.T, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	restful.DefaultContainer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestHealthz(t *testing.T) {
+	defer withReadinessChecks()()
+
+	// liveness doesn't depend on the checks
+	AddReadinessCheck("failing", func() error { return errors.New("failed") })
+
+	if rec := serveHealth(t, "/healthz"); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		checks map[string]error
+		status int
+	}{
+		{"no checks", nil, http.StatusOK},
+		{"all ok", map[string]error{"a": nil, "b": nil}, http.StatusOK},
+		{"one failing", map[string]error{"a": nil, "b": errors.New("b failed")}, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer withReadinessChecks()()
+
+			for _, name := range []string{"a", "b"} {
+				err, ok := tc.checks[name]
+				if !ok {
+					continue
+				}
+				AddReadinessCheck(name, func() error { return err })
+			}
+
+			rec := serveHealth(t, "/readyz")
+
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, rec.Code)
+			}
+
+			result := Readiness{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Ready != (tc.status == http.StatusOK) {
+				t.Errorf("unexpected ready: %v", result.Ready)
+			}
+
+			if len(result.Checks) != len(tc.checks) {
+				t.Fatalf("expected %d checks, got %+v", len(tc.checks), result.Checks)
+			}
+
+			// per-check results, in registration order
+			for i, name := range []string{"a", "b"}[:len(tc.checks)] {
+				r := result.Checks[i]
+				err := tc.checks[name]
+
+				if r.Name != name || r.OK != (err == nil) || r.Duration == "" {
+					t.Errorf("unexpected result for %s: %+v", name, r)
+				}
+				if err != nil && r.Error != err.Error() {
+					t.Errorf("%s: expected error %q, got %q", name, err, r.Error)
+				}
+			}
+		})
+	}
+}
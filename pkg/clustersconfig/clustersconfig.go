@@ -14,6 +14,8 @@ import (
 	"text/template"
 
 	yaml "gopkg.in/yaml.v2"
+
+	"novit.nc/direktil/local-server/pkg/macaddr"
 )
 
 var (
@@ -78,11 +80,13 @@ func (c *Config) HostByIP(ip string) *Host {
 }
 
 func (c *Config) HostByMAC(mac string) *Host {
-	// a bit of normalization
-	mac = strings.Replace(strings.ToLower(mac), "-", ":", -1)
+	mac = macaddr.Normalize(mac)
+	if mac == "" {
+		return nil
+	}
 
 	for _, host := range c.Hosts {
-		if strings.ToLower(host.MAC) == mac {
+		if macaddr.Normalize(host.MAC) == mac {
 			return host
 		}
 	}
@@ -0,0 +1,19 @@
+package macaddr
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Normalize returns the MAC address in lower case without separators, so the
+// usual formats (aa:bb:cc:dd:ee:ff, AA-BB-CC-DD-EE-FF, aabb.ccdd.eeff, aabbccddeeff)
+// of an address give the same value.
+func Normalize(mac string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '-', '.':
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, strings.TrimSpace(mac))
+}
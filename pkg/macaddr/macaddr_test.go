@@ -0,0 +1,23 @@
+package macaddr
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	for _, mac := range []string{
+		"aa:bb:cc:dd:ee:0f",
+		"AA:BB:CC:DD:EE:0F",
+		"aa-bb-cc-dd-ee-0f",
+		"Aa-Bb-Cc-Dd-Ee-0F",
+		"aabb.ccdd.ee0f",
+		"aabbccddee0f",
+		" aa:bb:cc:dd:ee:0f\n",
+	} {
+		if n := Normalize(mac); n != "aabbccddee0f" {
+			t.Errorf("%q: unexpected normalized MAC: %q", mac, n)
+		}
+	}
+
+	if n := Normalize(""); n != "" {
+		t.Errorf("unexpected normalized empty MAC: %q", n)
+	}
+}
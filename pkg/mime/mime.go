@@ -7,4 +7,7 @@ const (
 	ISO   = "application/x-iso9660-image"
 	IPXE  = "text/x-ipxe"
 	OCTET = "application/octet-stream"
+	TEXT  = "text/plain"
+	PEM   = "application/x-pem-file"
+	GZIP  = "application/gzip"
 )